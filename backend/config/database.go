@@ -2,6 +2,7 @@ package config
 
 import (
 	"context"
+	"line/metrics"
 	"log"
 	"time"
 
@@ -11,10 +12,13 @@ import (
 
 var DB *mongo.Database
 
+// dbClient is the client behind DB, kept so it can be disconnected on shutdown
+var dbClient *mongo.Client
+
 // ConnectDB connects to MongoDB and sets the global DB variable
 func ConnectDB() {
 	uri := GetEnv("MONGO_URI", "mongodb://localhost:27017")
-	client, err := mongo.NewClient(options.Client().ApplyURI(uri))
+	client, err := mongo.NewClient(options.Client().ApplyURI(uri).SetMonitor(metrics.CommandMonitor()))
 	if err != nil {
 		log.Fatal("Mongo client error:", err)
 	}
@@ -24,6 +28,7 @@ func ConnectDB() {
 	if err != nil {
 		log.Fatal("Mongo connect error:", err)
 	}
+	dbClient = client
 	DB = client.Database(GetEnv("MONGO_DB", "chatapp"))
 
 	// Create unique index for user email
@@ -37,3 +42,11 @@ func ConnectDB() {
 		log.Println("Could not create index for email:", err)
 	}
 }
+
+// DisconnectDB closes the MongoDB connections, waiting for in-use ones until ctx expires
+func DisconnectDB(ctx context.Context) error {
+	if dbClient == nil {
+		return nil
+	}
+	return dbClient.Disconnect(ctx)
+}
@@ -15,6 +15,7 @@ import (
 	"github.com/gin-gonic/gin"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
 	"golang.org/x/crypto/bcrypt"
 )
 
@@ -225,6 +226,56 @@ func UpdateUserProfile(c *gin.Context) {
 	})
 }
 
+// GetPrivacySettings returns the caller's own privacy settings
+func GetPrivacySettings(c *gin.Context) {
+	userID, ok := currentUserID(c)
+	if !ok {
+		return
+	}
+	if c.Param("id") != userID {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Cannot read another user's settings", "code": "forbidden"})
+		return
+	}
+	uid, _ := primitive.ObjectIDFromHex(userID)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var user models.User
+	opts := options.FindOne().SetProjection(bson.M{"readReceiptsDisabled": 1})
+	if err := config.DB.Collection("users").FindOne(ctx, bson.M{"_id": uid}, opts).Decode(&user); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"readReceipts": !user.ReadReceiptsDisabled})
+}
+
+// UpdatePrivacySettings lets a user turn their read receipts on or off
+func UpdatePrivacySettings(c *gin.Context) {
+	userID, ok := currentUserID(c)
+	if !ok {
+		return
+	}
+	if c.Param("id") != userID {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Cannot change another user's settings", "code": "forbidden"})
+		return
+	}
+	var req struct {
+		ReadReceipts *bool `json:"readReceipts"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil || req.ReadReceipts == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input"})
+		return
+	}
+	uid, _ := primitive.ObjectIDFromHex(userID)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err := config.DB.Collection("users").UpdateByID(ctx, uid, bson.M{"$set": bson.M{"readReceiptsDisabled": !*req.ReadReceipts}})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update settings"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Settings updated", "readReceipts": *req.ReadReceipts})
+}
+
 // UploadUserAvatar handles avatar uploads for a user
 func UploadUserAvatar(c *gin.Context) {
 	userID := c.Param("id")
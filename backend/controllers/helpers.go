@@ -0,0 +1,30 @@
+package controllers
+
+import (
+	"errors"
+	"line/models"
+	"line/services"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// currentUserID returns the ID of the user set by the JWTAuth middleware
+func currentUserID(c *gin.Context) (string, bool) {
+	userI, exists := c.Get("user")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return "", false
+	}
+	return userI.(models.User).ID.Hex(), true
+}
+
+// respondError writes a service error with its status and code, or a generic 500
+func respondError(c *gin.Context, err error) {
+	var svcErr *services.Error
+	if errors.As(err, &svcErr) {
+		c.JSON(svcErr.Status(), gin.H{"error": svcErr.Error(), "code": svcErr.Code()})
+		return
+	}
+	c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal error", "code": "internal"})
+}
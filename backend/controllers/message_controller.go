@@ -2,293 +2,259 @@ package controllers
 
 import (
 	"context"
-	"line/config"
-	"line/models"
+	"line/services"
 	"line/sockets"
-	"line/utils"
 	"net/http"
-	"strings"
+	"strconv"
 	"time"
 
-	"fmt"
-
 	"github.com/gin-gonic/gin"
-	"go.mongodb.org/mongo-driver/bson"
-	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
+// GetRoomMessages returns a page of a room's messages, oldest first
+// Query parameters: limit (default 50, at most 200) and one of before, after (a cursor from an
+// earlier page or a message ID) or around (a message ID to center the page on)
 func GetRoomMessages(c *gin.Context) {
-	roomID := c.Param("id")
-	before := c.Query("before")
-	limit := 50
-
-	rid, err := primitive.ObjectIDFromHex(roomID)
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid room ID"})
+	userID, ok := currentUserID(c)
+	if !ok {
 		return
 	}
-
-	// Build the aggregation pipeline
-	pipeline := []bson.M{
-		{"$match": bson.M{"roomId": rid}},
-	}
-
-	if before != "" {
-		bid, err := primitive.ObjectIDFromHex(before)
-		if err == nil {
-			pipeline = append(pipeline, bson.M{"$match": bson.M{"_id": bson.M{"$lt": bid}}})
-		}
+	q, ok := pageQuery(c)
+	if !ok {
+		return
 	}
-
-	pipeline = append(pipeline,
-		bson.M{"$sort": bson.M{"timestamp": -1}},
-		bson.M{"$limit": limit},
-		// Lookup for replied message
-		bson.M{
-			"$lookup": bson.M{
-				"from":         "messages",
-				"localField":   "replyTo",
-				"foreignField": "_id",
-				"as":           "repliedMessageDocs",
-			},
-		},
-		// Lookup for sender of replied message
-		bson.M{
-			"$lookup": bson.M{
-				"from":         "users",
-				"localField":   "repliedMessageDocs.senderId",
-				"foreignField": "_id",
-				"as":           "repliedMessageSenders",
-			},
-		},
-		// Add fields to shape the output
-		bson.M{
-			"$addFields": bson.M{
-				"repliedMessage": bson.M{
-					"$cond": bson.M{
-						"if": bson.M{"$gt": bson.A{bson.M{"$size": "$repliedMessageDocs"}, 0}},
-						"then": bson.M{
-							"senderId":   bson.M{"$toString": bson.M{"$arrayElemAt": bson.A{"$repliedMessageDocs.senderId", 0}}},
-							"senderName": bson.M{"$arrayElemAt": bson.A{"$repliedMessageSenders.username", 0}},
-							"content":    bson.M{"$arrayElemAt": bson.A{"$repliedMessageDocs.content", 0}},
-							"mediaUrl":   bson.M{"$arrayElemAt": bson.A{"$repliedMessageDocs.mediaUrl", 0}},
-						},
-						"else": nil,
-					},
-				},
-			},
-		},
-		// Project the final fields
-		bson.M{
-			"$project": bson.M{
-				"repliedMessageDocs":    0,
-				"repliedMessageSenders": 0,
-			},
-		},
-		// Sort back to ascending for display
-		bson.M{"$sort": bson.M{"timestamp": 1}},
-	)
-
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
-
-	cursor, err := config.DB.Collection("messages").Aggregate(ctx, pipeline)
+	page, err := services.Messages.Page(ctx, userID, c.Param("id"), q)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "DB aggregation error"})
+		respondError(c, err)
 		return
 	}
-
-	var messages []models.Message
-	if err = cursor.All(ctx, &messages); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "DB cursor error"})
-		return
-	}
-
-	c.JSON(http.StatusOK, messages)
+	c.JSON(http.StatusOK, page)
 }
 
-// Mark all messages in a room as read by the current user
-func MarkRoomMessagesRead(c *gin.Context) {
-	roomID := c.Param("id")
-	token := c.GetHeader("Authorization")
-	if token != "" {
-		token = strings.TrimPrefix(token, "Bearer ")
+// GetThread returns the root of a thread and a page of its replies, oldest first
+// It takes the same query parameters as GetRoomMessages
+func GetThread(c *gin.Context) {
+	userID, ok := currentUserID(c)
+	if !ok {
+		return
 	}
-	if token == "" {
-		fmt.Println("Missing token")
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Missing token"})
+	q, ok := pageQuery(c)
+	if !ok {
 		return
 	}
-	userID, err := utils.ParseJWT(token)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	page, err := services.Messages.Thread(ctx, userID, c.Param("msgId"), q)
 	if err != nil {
-		fmt.Println("Invalid token:", err)
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
+		respondError(c, err)
 		return
 	}
-	uid, err := primitive.ObjectIDFromHex(userID)
-	if err != nil {
-		fmt.Println("Invalid user ID in token:", err)
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid user ID in token"})
+	c.JSON(http.StatusOK, page)
+}
+
+// pageQuery reads the paging parameters of a history request, answering 400 when limit is invalid
+func pageQuery(c *gin.Context) (services.PageQuery, bool) {
+	q := services.PageQuery{
+		Before: c.Query("before"),
+		After:  c.Query("after"),
+		Around: c.Query("around"),
+	}
+	if limit := c.Query("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 1 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "limit must be a positive number", "code": "bad_request"})
+			return q, false
+		}
+		q.Limit = n
+	}
+	return q, true
+}
+
+// SendMessage posts a message to a room over REST, for clients that cannot keep a socket open
+// It goes through the same service as socket messages, so room members get the same message event
+func SendMessage(c *gin.Context) {
+	userID, ok := currentUserID(c)
+	if !ok {
 		return
 	}
-	rid, err := primitive.ObjectIDFromHex(roomID)
-	if err != nil {
-		fmt.Println("Invalid room ID:", err)
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid room ID"})
+	var req sockets.MessageRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input"})
 		return
 	}
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	req.RoomID = c.Param("id")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
-	_, err = config.DB.Collection("messages").UpdateMany(ctx, bson.M{"roomId": rid, "readBy": bson.M{"$ne": uid}}, bson.M{"$addToSet": bson.M{"readBy": uid}})
+	msg, err := services.Messages.Send(ctx, userID, req)
 	if err != nil {
-		fmt.Println("DB error in MarkRoomMessagesRead:", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "DB error", "details": err.Error()})
+		respondError(c, err)
 		return
 	}
-	c.JSON(http.StatusOK, gin.H{"message": "Marked as read"})
+	c.JSON(http.StatusOK, msg)
 }
 
-// Pin a message
-func PinMessage(c *gin.Context) {
-	msgId := c.Param("msgId")
-	id, err := primitive.ObjectIDFromHex(msgId)
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid message ID"})
+// GetMentions returns the messages mentioning the current user, newest first
+// Query parameters: limit (default 50, at most 200), before (the nextCursor of an earlier page) and
+// unread=true to list only mentions not read yet
+func GetMentions(c *gin.Context) {
+	userID, ok := currentUserID(c)
+	if !ok {
 		return
 	}
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	q := services.MentionQuery{Before: c.Query("before"), Unread: c.Query("unread") == "true"}
+	if limit := c.Query("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 1 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "limit must be a positive number", "code": "bad_request"})
+			return
+		}
+		q.Limit = n
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
-	_, err = config.DB.Collection("messages").UpdateByID(ctx, id, bson.M{"$set": bson.M{"pinned": true}})
+	page, err := services.Messages.Mentions(ctx, userID, q)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "DB error"})
+		respondError(c, err)
 		return
 	}
-	var msg models.Message
-	_ = config.DB.Collection("messages").FindOne(ctx, bson.M{"_id": id}).Decode(&msg)
-	roomId := msg.RoomID.Hex()
-	sockets.H.Pin <- sockets.PinEvent{Type: "pin", RoomID: roomId, MessageID: msgId, Message: msg}
-	c.JSON(http.StatusOK, gin.H{"message": "Pinned"})
+	c.JSON(http.StatusOK, page)
 }
 
-// Unpin a message
-func UnpinMessage(c *gin.Context) {
-	msgId := c.Param("msgId")
-	id, err := primitive.ObjectIDFromHex(msgId)
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid message ID"})
+// Mark all messages in a room as read by the current user
+func MarkRoomMessagesRead(c *gin.Context) {
+	userID, ok := currentUserID(c)
+	if !ok {
 		return
 	}
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
-	_, err = config.DB.Collection("messages").UpdateByID(ctx, id, bson.M{"$set": bson.M{"pinned": false}})
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "DB error"})
+	if err := services.Messages.MarkRead(ctx, userID, c.Param("id")); err != nil {
+		respondError(c, err)
 		return
 	}
-	var msg models.Message
-	_ = config.DB.Collection("messages").FindOne(ctx, bson.M{"_id": id}).Decode(&msg)
-	roomId := msg.RoomID.Hex()
-	sockets.H.Pin <- sockets.PinEvent{Type: "unpin", RoomID: roomId, MessageID: msgId, Message: msg}
-	c.JSON(http.StatusOK, gin.H{"message": "Unpinned"})
+	c.JSON(http.StatusOK, gin.H{"message": "Marked as read"})
 }
 
-// Star a message
-func StarMessage(c *gin.Context) {
-	msgId := c.Param("msgId")
-	token := c.GetHeader("Authorization")
-	if token != "" {
-		token = strings.TrimPrefix(token, "Bearer ")
-	}
-	userID, err := utils.ParseJWT(token)
-	if err != nil {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
+// messageAction runs a service action on the message in the URL for the current user
+func messageAction(c *gin.Context, action func(ctx context.Context, userID, messageID string) error, reply string) {
+	userID, ok := currentUserID(c)
+	if !ok {
 		return
 	}
-	uid, err := primitive.ObjectIDFromHex(userID)
-	if err != nil {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid user ID in token"})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := action(ctx, userID, c.Param("msgId")); err != nil {
+		respondError(c, err)
 		return
 	}
-	id, err := primitive.ObjectIDFromHex(msgId)
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid message ID"})
+	c.JSON(http.StatusOK, gin.H{"message": reply})
+}
+
+// GetMessageInfo lists when a message was delivered to and read by each room member
+func GetMessageInfo(c *gin.Context) {
+	userID, ok := currentUserID(c)
+	if !ok {
 		return
 	}
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
-	_, err = config.DB.Collection("messages").UpdateByID(ctx, id, bson.M{"$addToSet": bson.M{"starredBy": uid}})
+	receipts, err := services.Messages.Info(ctx, userID, c.Param("msgId"))
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "DB error"})
+		respondError(c, err)
 		return
 	}
-	var msg models.Message
-	_ = config.DB.Collection("messages").FindOne(ctx, bson.M{"_id": id}).Decode(&msg)
-	roomId := msg.RoomID.Hex()
-	sockets.H.Star <- sockets.StarEvent{Type: "star", RoomID: roomId, MessageID: msgId, Message: msg}
-	c.JSON(http.StatusOK, gin.H{"message": "Starred"})
+	c.JSON(http.StatusOK, gin.H{"messageId": c.Param("msgId"), "members": receipts})
+}
+
+// Pin a message
+func PinMessage(c *gin.Context) {
+	messageAction(c, services.Messages.Pin, "Pinned")
+}
+
+// Unpin a message
+func UnpinMessage(c *gin.Context) {
+	messageAction(c, services.Messages.Unpin, "Unpinned")
+}
+
+// Star a message
+func StarMessage(c *gin.Context) {
+	messageAction(c, services.Messages.Star, "Starred")
 }
 
 // Unstar a message
 func UnstarMessage(c *gin.Context) {
-	msgId := c.Param("msgId")
-	token := c.GetHeader("Authorization")
-	if token != "" {
-		token = strings.TrimPrefix(token, "Bearer ")
+	messageAction(c, services.Messages.Unstar, "Unstarred")
+}
+
+// DeleteMessage deletes a message for everyone, or only for the current user with ?scope=me
+func DeleteMessage(c *gin.Context) {
+	switch c.DefaultQuery("scope", sockets.DeleteForEveryone) {
+	case sockets.DeleteForEveryone:
+		messageAction(c, services.Messages.Delete, "Deleted")
+	case sockets.DeleteForMe:
+		messageAction(c, services.Messages.Hide, "Deleted for you")
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "scope must be me or everyone", "code": "bad_request"})
 	}
-	userID, err := utils.ParseJWT(token)
-	if err != nil {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
+}
+
+// EditMessage replaces the content of one of the current user's messages
+func EditMessage(c *gin.Context) {
+	userID, ok := currentUserID(c)
+	if !ok {
 		return
 	}
-	uid, err := primitive.ObjectIDFromHex(userID)
-	if err != nil {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid user ID in token"})
-		return
+	var req struct {
+		Content string `json:"content"`
 	}
-	id, err := primitive.ObjectIDFromHex(msgId)
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid message ID"})
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input"})
 		return
 	}
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
-	_, err = config.DB.Collection("messages").UpdateByID(ctx, id, bson.M{"$pull": bson.M{"starredBy": uid}})
+	msg, err := services.Messages.Edit(ctx, userID, c.Param("msgId"), req.Content)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "DB error"})
+		respondError(c, err)
 		return
 	}
-	var msg models.Message
-	_ = config.DB.Collection("messages").FindOne(ctx, bson.M{"_id": id}).Decode(&msg)
-	roomId := msg.RoomID.Hex()
-	sockets.H.Star <- sockets.StarEvent{Type: "unstar", RoomID: roomId, MessageID: msgId, Message: msg}
-	c.JSON(http.StatusOK, gin.H{"message": "Unstarred"})
+	c.JSON(http.StatusOK, msg)
 }
 
-// Delete a message
-func DeleteMessage(c *gin.Context) {
-	msgId := c.Param("msgId")
-	id, err := primitive.ObjectIDFromHex(msgId)
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid message ID"})
+// GetMessageRevisions lists the earlier contents of an edited message
+func GetMessageRevisions(c *gin.Context) {
+	userID, ok := currentUserID(c)
+	if !ok {
 		return
 	}
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
-	var msg models.Message
-	_ = config.DB.Collection("messages").FindOne(ctx, bson.M{"_id": id}).Decode(&msg)
-	roomId := msg.RoomID.Hex()
-	_, err = config.DB.Collection("messages").DeleteOne(ctx, bson.M{"_id": id})
+	revisions, err := services.Messages.Revisions(ctx, userID, c.Param("msgId"))
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "DB error"})
+		respondError(c, err)
 		return
 	}
-	sockets.H.Delete <- sockets.DeleteEvent{Type: "delete", RoomID: roomId, MessageID: msgId}
-	c.JSON(http.StatusOK, gin.H{"message": "Deleted"})
+	c.JSON(http.StatusOK, gin.H{"messageId": c.Param("msgId"), "revisions": revisions})
+}
+
+// Follow the thread of a message
+func FollowThread(c *gin.Context) {
+	messageAction(c, services.Messages.FollowThread, "Following")
+}
+
+// Unfollow the thread of a message
+func UnfollowThread(c *gin.Context) {
+	messageAction(c, services.Messages.UnfollowThread, "Unfollowed")
 }
 
 // Forward a message to another room
 func ForwardMessage(c *gin.Context) {
-	msgId := c.Param("msgId")
+	userID, ok := currentUserID(c)
+	if !ok {
+		return
+	}
 	var req struct {
 		ToRoomId string `json:"toRoomId"`
 	}
@@ -296,41 +262,11 @@ func ForwardMessage(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input"})
 		return
 	}
-	id, err := primitive.ObjectIDFromHex(msgId)
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid message ID"})
-		return
-	}
-	toRoomId, err := primitive.ObjectIDFromHex(req.ToRoomId)
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid room ID"})
-		return
-	}
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
-	var orig models.Message
-	err = config.DB.Collection("messages").FindOne(ctx, bson.M{"_id": id}).Decode(&orig)
-	if err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Original message not found"})
-		return
-	}
-	newMsg := models.Message{
-		RoomID:    toRoomId,
-		SenderID:  orig.SenderID,
-		Content:   orig.Content,
-		MediaURL:  orig.MediaURL,
-		Timestamp: time.Now(),
-		ReadBy:    []primitive.ObjectID{},
-		Reactions: map[string][]primitive.ObjectID{},
-		Pinned:    false,
-		StarredBy: []primitive.ObjectID{},
-	}
-	res, err := config.DB.Collection("messages").InsertOne(ctx, newMsg)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "DB error"})
+	if _, err := services.Messages.Forward(ctx, userID, c.Param("msgId"), req.ToRoomId); err != nil {
+		respondError(c, err)
 		return
 	}
-	newMsg.ID = res.InsertedID.(primitive.ObjectID)
-	sockets.H.Forward <- sockets.ForwardEvent{Type: "forward", RoomID: req.ToRoomId, MessageID: newMsg.ID.Hex(), Message: newMsg}
 	c.JSON(http.StatusOK, gin.H{"message": "Forwarded"})
 }
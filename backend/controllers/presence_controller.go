@@ -0,0 +1,41 @@
+package controllers
+
+import (
+	"context"
+	"line/sockets"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// maxPresenceIDs caps how many users one presence query may ask about
+const maxPresenceIDs = 100
+
+// GetPresence returns the current presence and last-seen time of the users in ?ids=a,b,c
+// Only the caller, their contacts and their room co-members are reported; other IDs are left out
+func GetPresence(c *gin.Context) {
+	userID, ok := currentUserID(c)
+	if !ok {
+		return
+	}
+	ids := []string{}
+	for _, id := range strings.Split(c.Query("ids"), ",") {
+		if id = strings.TrimSpace(id); id != "" {
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) == 0 || len(ids) > maxPresenceIDs {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "ids must list between 1 and 100 user IDs", "code": "bad_request"})
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	presence, err := sockets.LookupPresence(ctx, userID, ids)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch presence"})
+		return
+	}
+	c.JSON(http.StatusOK, presence)
+}
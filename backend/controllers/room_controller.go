@@ -4,6 +4,7 @@ import (
 	"context"
 	"line/config"
 	"line/models"
+	"line/sockets"
 	"line/utils"
 	"net/http"
 	"strings"
@@ -18,8 +19,16 @@ import (
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
+// GetUserRooms lists the caller's rooms with their last message, unread count and unread mentions
 func GetUserRooms(c *gin.Context) {
-	userID := c.Param("id")
+	userID, ok := currentUserID(c)
+	if !ok {
+		return
+	}
+	if c.Param("id") != userID {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Cannot list another user's rooms", "code": "forbidden"})
+		return
+	}
 	uid, err := primitive.ObjectIDFromHex(userID)
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
@@ -42,9 +51,9 @@ func GetUserRooms(c *gin.Context) {
 	var result []gin.H
 	for _, room := range rooms {
 		msgColl := config.DB.Collection("messages")
-		// Last message
+		// Last message; thread replies stay in their thread and do not count here
 		var lastMsg models.Message
-		err := msgColl.FindOne(ctx, bson.M{"roomId": room.ID}, &options.FindOneOptions{
+		err := msgColl.FindOne(ctx, bson.M{"roomId": room.ID, "threadId": nil, "hiddenFor": bson.M{"$ne": uid}}, &options.FindOneOptions{
 			Sort: bson.M{"timestamp": -1},
 		}).Decode(&lastMsg)
 		lastMessage := gin.H{}
@@ -52,19 +61,37 @@ func GetUserRooms(c *gin.Context) {
 			lastMessage = gin.H{
 				"content":   lastMsg.Content,
 				"timestamp": lastMsg.Timestamp,
+				"deleted":   lastMsg.Deleted,
 			}
 		}
-		// Unread count
-		unreadCount, _ := msgColl.CountDocuments(ctx, bson.M{"roomId": room.ID, "readBy": bson.M{"$ne": uid}})
+		// Unread count, leaving out messages deleted for everyone or hidden by the user
+		// A reader without read receipts is recorded in readPrivately rather than readBy
+		read := bson.A{bson.M{"readBy": uid}, bson.M{"readPrivately": uid}}
+		unreadCount, _ := msgColl.CountDocuments(ctx, bson.M{
+			"roomId":    room.ID,
+			"threadId":  nil,
+			"$nor":      read,
+			"hiddenFor": bson.M{"$ne": uid},
+			"deleted":   bson.M{"$ne": true},
+		})
+		// Unread messages mentioning the user, thread replies included
+		unreadMentions, _ := msgColl.CountDocuments(ctx, bson.M{
+			"roomId":         room.ID,
+			"mentionedUsers": uid,
+			"$nor":           read,
+			"hiddenFor":      bson.M{"$ne": uid},
+			"deleted":        bson.M{"$ne": true},
+		})
 		result = append(result, gin.H{
-			"id":          room.ID,
-			"name":        room.Name,
-			"members":     room.Members,
-			"isGroup":     room.IsGroup,
-			"avatar":      room.Avatar,
-			"description": room.Description,
-			"lastMessage": lastMessage,
-			"unreadCount": unreadCount,
+			"id":             room.ID,
+			"name":           room.Name,
+			"members":        room.Members,
+			"isGroup":        room.IsGroup,
+			"avatar":         room.Avatar,
+			"description":    room.Description,
+			"lastMessage":    lastMessage,
+			"unreadCount":    unreadCount,
+			"unreadMentions": unreadMentions,
 		})
 	}
 	c.JSON(http.StatusOK, result)
@@ -121,6 +148,7 @@ func CreateRoom(c *gin.Context) {
 		Name:    req.Name,
 		Members: memberIDs,
 		IsGroup: req.IsGroup,
+		Admins:  []primitive.ObjectID{creatorObjID},
 	}
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
@@ -130,6 +158,7 @@ func CreateRoom(c *gin.Context) {
 		return
 	}
 	room.ID = res.InsertedID.(primitive.ObjectID)
+	sockets.H.InvalidateMembership(room.ID.Hex())
 	c.JSON(http.StatusOK, room)
 }
 
@@ -0,0 +1,84 @@
+package controllers
+
+import (
+	"context"
+	"line/services"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ScheduleMessage stores a message to be sent to a room later
+// Body: roomId, content and/or mediaUrl, optional replyTo and threadId, and sendAt as an RFC 3339 time
+func ScheduleMessage(c *gin.Context) {
+	userID, ok := currentUserID(c)
+	if !ok {
+		return
+	}
+	var req services.ScheduleRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input"})
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	scheduled, err := services.Messages.Schedule(ctx, userID, req)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	c.JSON(http.StatusCreated, scheduled)
+}
+
+// GetScheduledMessages lists the current user's pending and failed scheduled messages, optionally for one roomId
+func GetScheduledMessages(c *gin.Context) {
+	userID, ok := currentUserID(c)
+	if !ok {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	scheduled, err := services.Messages.Scheduled(ctx, userID, c.Query("roomId"))
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"scheduled": scheduled})
+}
+
+// UpdateScheduledMessage changes the content, media or send time of a scheduled message
+func UpdateScheduledMessage(c *gin.Context) {
+	userID, ok := currentUserID(c)
+	if !ok {
+		return
+	}
+	var req services.ScheduleUpdate
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input"})
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	scheduled, err := services.Messages.UpdateScheduled(ctx, userID, c.Param("id"), req)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, scheduled)
+}
+
+// CancelScheduledMessage deletes a scheduled message that has not been sent
+func CancelScheduledMessage(c *gin.Context) {
+	userID, ok := currentUserID(c)
+	if !ok {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := services.Messages.CancelScheduled(ctx, userID, c.Param("id")); err != nil {
+		respondError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Cancelled"})
+}
@@ -0,0 +1,86 @@
+package controllers
+
+import (
+	"context"
+	"line/services"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// SearchMessages runs a full-text search over the messages of the current user's rooms
+// Query parameters: q, and optionally roomId, senderId, from and to (RFC 3339 or YYYY-MM-DD),
+// hasMedia (true or false), limit (default 20, at most 50) and offset
+func SearchMessages(c *gin.Context) {
+	userID, ok := currentUserID(c)
+	if !ok {
+		return
+	}
+	q := services.SearchQuery{
+		Text:     c.Query("q"),
+		RoomID:   c.Query("roomId"),
+		SenderID: c.Query("senderId"),
+	}
+	var err error
+	if q.From, err = parseSearchTime(c.Query("from"), false); err != nil {
+		badSearchParam(c, "from must be an RFC 3339 time or a YYYY-MM-DD date")
+		return
+	}
+	if q.To, err = parseSearchTime(c.Query("to"), true); err != nil {
+		badSearchParam(c, "to must be an RFC 3339 time or a YYYY-MM-DD date")
+		return
+	}
+	if v := c.Query("hasMedia"); v != "" {
+		hasMedia, err := strconv.ParseBool(v)
+		if err != nil {
+			badSearchParam(c, "hasMedia must be true or false")
+			return
+		}
+		q.HasMedia = &hasMedia
+	}
+	if v := c.Query("limit"); v != "" {
+		if q.Limit, err = strconv.Atoi(v); err != nil || q.Limit < 1 {
+			badSearchParam(c, "limit must be a positive number")
+			return
+		}
+	}
+	if v := c.Query("offset"); v != "" {
+		if q.Offset, err = strconv.Atoi(v); err != nil || q.Offset < 0 {
+			badSearchParam(c, "offset must not be negative")
+			return
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	results, err := services.Messages.Search(ctx, userID, q)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, results)
+}
+
+// parseSearchTime reads a time filter; a bare date covers the whole day, so as an end bound it means its last instant
+func parseSearchTime(v string, end bool) (time.Time, error) {
+	if v == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse("2006-01-02", v)
+	if err != nil {
+		return t, err
+	}
+	if end {
+		t = t.Add(24*time.Hour - time.Millisecond)
+	}
+	return t, nil
+}
+
+func badSearchParam(c *gin.Context, msg string) {
+	c.JSON(http.StatusBadRequest, gin.H{"error": msg, "code": "bad_request"})
+}
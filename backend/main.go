@@ -1,11 +1,18 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"line/config"
+	"line/middleware"
 	"line/routes"
+	"line/services"
 	"line/sockets"
+	"log"
+	"net/http"
 	"os"
-
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/gin-contrib/cors"
@@ -16,10 +23,24 @@ import (
 func main() {
 	config.LoadEnv()
 	config.ConnectDB()
+	sockets.LoadOptions()
+	services.LoadOptions()
+	sockets.EnsureEventLog()
+	sockets.EnsurePresence()
+	services.EnsureIndexes()
+	services.EnsureRoomAdmins()
 
+	broker, err := sockets.NewBroker()
+	if err != nil {
+		log.Fatal("Hub broker error:", err)
+	}
+	sockets.H.UseBroker(broker)
+	sockets.Actions = services.Messages
 	go sockets.H.Run()
+	go services.Scheduler.Run()
 
 	r := gin.Default()
+	r.Use(middleware.Metrics("/ws", "/events", "/poll"))
 
 	r.Use(cors.New(cors.Config{
 		AllowOrigins:     []string{"*"},
@@ -40,10 +61,64 @@ func main() {
 	routes.StorageRoutes(r)
 	routes.WebSocketRoutes(r)
 	routes.ContactRoutes(r)
+	routes.SearchRoutes(r)
+	routes.ScheduleRoutes(r)
 
 	port := os.Getenv("PORT")
 	if port == "" {
 		port = "8080"
 	}
-	r.Run(":" + port)
+	srv := &http.Server{Addr: ":" + port, Handler: r}
+	// Hijacked sockets and streaming fallbacks are not waited on by Shutdown, so tell them to go away
+	srv.RegisterOnShutdown(sockets.H.GoAway)
+
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatal("Server error:", err)
+		}
+	}()
+
+	// Metrics and hub stats are served apart from the API, on a loopback address by default
+	internal := gin.New()
+	internal.Use(gin.Recovery())
+	routes.InternalRoutes(internal)
+	internalSrv := &http.Server{Addr: config.GetEnv("INTERNAL_ADDR", "127.0.0.1:9090"), Handler: internal}
+	go func() {
+		if err := internalSrv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Println("Internal server error:", err)
+		}
+	}()
+
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+	<-quit
+	shutdown(srv, internalSrv, config.GetEnvDuration("SHUTDOWN_TIMEOUT", 15*time.Second))
+}
+
+// shutdown stops the server in order within timeout
+// New connections are refused first, then in-flight requests, socket frames and scheduled sends
+// finish, the hub publishes what it has queued and finally MongoDB is disconnected
+// The internal listener stays up until the end so metrics can be scraped while draining
+func shutdown(srv, internalSrv *http.Server, timeout time.Duration) {
+	log.Println("Shutting down, deadline", timeout)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Println("HTTP shutdown error:", err)
+	}
+	// The scheduler sends through the hub, so it stops first
+	if err := services.Scheduler.Shutdown(ctx); err != nil {
+		log.Println("Scheduler shutdown error:", err)
+	}
+	if err := sockets.H.Shutdown(ctx); err != nil {
+		log.Println("Hub shutdown error:", err)
+	}
+	if err := internalSrv.Shutdown(ctx); err != nil {
+		log.Println("Internal server shutdown error:", err)
+	}
+	if err := config.DisconnectDB(ctx); err != nil {
+		log.Println("Mongo disconnect error:", err)
+	}
+	log.Println("Shutdown complete")
 }
@@ -0,0 +1,57 @@
+package metrics
+
+import (
+	"context"
+	"sync"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/event"
+)
+
+// CommandMonitor records the latency and failures of every command the MongoDB driver runs
+// The collection is taken from the started event, since finished events do not carry the command
+func CommandMonitor() *event.CommandMonitor {
+	var inflight sync.Map // request ID -> collection name
+	return &event.CommandMonitor{
+		Started: func(_ context.Context, e *event.CommandStartedEvent) {
+			inflight.Store(e.RequestID, commandCollection(e.CommandName, e.Command))
+		},
+		Succeeded: func(_ context.Context, e *event.CommandSucceededEvent) {
+			collection := finish(&inflight, e.RequestID)
+			MongoDuration.WithLabelValues(e.CommandName, collection).Observe(e.Duration.Seconds())
+		},
+		Failed: func(_ context.Context, e *event.CommandFailedEvent) {
+			collection := finish(&inflight, e.RequestID)
+			MongoDuration.WithLabelValues(e.CommandName, collection).Observe(e.Duration.Seconds())
+			MongoErrors.WithLabelValues(e.CommandName, collection).Inc()
+		},
+	}
+}
+
+// finish forgets a started command and returns its collection
+func finish(inflight *sync.Map, requestID int64) string {
+	collection, ok := inflight.LoadAndDelete(requestID)
+	if !ok {
+		return ""
+	}
+	return collection.(string)
+}
+
+// commandCollection returns the collection a command targets
+// Most commands name it as the value of their first element; getMore names it in "collection"
+func commandCollection(name string, cmd bson.Raw) string {
+	if name == "getMore" {
+		if coll, ok := cmd.Lookup("collection").StringValueOK(); ok {
+			return coll
+		}
+		return ""
+	}
+	elems, err := cmd.Elements()
+	if err != nil || len(elems) == 0 {
+		return ""
+	}
+	if coll, ok := elems[0].Value().StringValueOK(); ok {
+		return coll
+	}
+	return ""
+}
@@ -0,0 +1,33 @@
+package middleware
+
+import (
+	"line/metrics"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Metrics records the latency of each request under its gin route template
+// Routes listed in skip hold connections open (sockets, streams) and would only skew the histogram
+func Metrics(skip ...string) gin.HandlerFunc {
+	skipped := make(map[string]bool, len(skip))
+	for _, route := range skip {
+		skipped[route] = true
+	}
+	return func(c *gin.Context) {
+		route := c.FullPath()
+		if skipped[route] {
+			c.Next()
+			return
+		}
+		start := time.Now()
+		c.Next()
+		if route == "" {
+			// Keep unknown paths from creating a series each
+			route = "unmatched"
+		}
+		status := strconv.Itoa(c.Writer.Status())
+		metrics.HTTPDuration.WithLabelValues(c.Request.Method, route, status).Observe(time.Since(start).Seconds())
+	}
+}
@@ -7,11 +7,49 @@ import (
 )
 
 // RepliedMessageInfo represents the information about a message being replied to
+// Deleted is set when the original was deleted for everyone
 type RepliedMessageInfo struct {
-	SenderID   string `json:"senderId"`
-	SenderName string `json:"senderName"`
-	Content    string `json:"content"`
-	MediaURL   string `json:"mediaUrl,omitempty"`
+	SenderID   string `bson:"senderId" json:"senderId"`
+	SenderName string `bson:"senderName" json:"senderName"`
+	Content    string `bson:"content" json:"content"`
+	MediaURL   string `bson:"mediaUrl,omitempty" json:"mediaUrl,omitempty"`
+	Deleted    bool   `bson:"deleted,omitempty" json:"deleted,omitempty"`
+}
+
+// Mention types
+const (
+	MentionUser = "user"
+	MentionAll  = "all"
+)
+
+// Mention is an @username or @all entity parsed from a message's content
+// Offset and Length locate it, "@" included, in characters (Unicode code points) of the content
+// UserID and Username are set for a user mention; @all mentions every other member of the room
+type Mention struct {
+	Type     string              `bson:"type" json:"type"`
+	UserID   *primitive.ObjectID `bson:"userId,omitempty" json:"userId,omitempty"`
+	Username string              `bson:"username,omitempty" json:"username,omitempty"`
+	Offset   int                 `bson:"offset" json:"offset"`
+	Length   int                 `bson:"length" json:"length"`
+}
+
+// Receipt records when a user got or read a message
+type Receipt struct {
+	UserID primitive.ObjectID `bson:"userId" json:"userId"`
+	At     time.Time          `bson:"at" json:"at"`
+}
+
+// Revision is an earlier content of an edited message
+// At is when that content was written: when the message was sent or the edit that produced it
+type Revision struct {
+	Content string    `bson:"content" json:"content"`
+	At      time.Time `bson:"at" json:"at"`
+}
+
+// ForwardOrigin names the message a forward was copied from and that message's sender
+type ForwardOrigin struct {
+	MessageID primitive.ObjectID `bson:"messageId" json:"messageId"`
+	SenderID  primitive.ObjectID `bson:"senderId" json:"senderId"`
 }
 
 // Message represents a chat message in a room
@@ -19,24 +57,53 @@ type RepliedMessageInfo struct {
 // RoomID is the room this message belongs to
 // SenderID is the user who sent the message
 // ReplyTo is a pointer to the ID of the message this message is replying to
+// ThreadID is set on thread replies to the ID of the thread's root message
 // Content is the text content
 // MediaURL is the optional media file URL
 // Timestamp is when the message was sent
+// ForwardedFrom is set on forwarded copies to the original message; SenderID is then the forwarder
+// Mentions are the @mentions in Content and MentionedUsers the users they resolve to, @all expanded
+// EditedAt is when the sender last edited the content and Revisions holds the contents it replaced, oldest first
 // ReadBy is a list of user IDs who have read the message
+// ReadPrivately lists readers who turned read receipts off; it only counts towards unread totals
+// ReadReceipts records when each user in ReadBy read the message
+// DeliveredTo records when the message reached a device of each recipient
+// Receipts are never serialized with the message; GET /messages/:msgId/info reports them
 // Reactions is a map from emoji to user IDs who reacted
 // Pinned is a boolean indicating whether the message is pinned
 // StarredBy is a list of user IDs who have starred the message
+// HiddenFor lists the users who deleted the message for themselves only
+// ReplyCount and LastReplyAt summarize the thread of a root message; ThreadFollowers are notified of its replies
+// ScheduledID is set on messages sent by the scheduler to the scheduled message they came from
+// Deleted marks a tombstone left by a delete for everyone, with DeletedAt and DeletedBy; its content is cleared
 type Message struct {
-	ID             primitive.ObjectID              `bson:"_id,omitempty" json:"id"`
-	RoomID         primitive.ObjectID              `bson:"roomId" json:"roomId"`
-	SenderID       primitive.ObjectID              `bson:"senderId" json:"senderId"`
-	ReplyTo        *primitive.ObjectID             `bson:"replyTo,omitempty" json:"replyTo,omitempty"`
-	Content        string                          `bson:"content" json:"content"`
-	MediaURL       string                          `bson:"mediaUrl,omitempty" json:"mediaUrl,omitempty"`
-	Timestamp      time.Time                       `bson:"timestamp" json:"timestamp"`
-	ReadBy         []primitive.ObjectID            `bson:"readBy" json:"readBy"`
-	Reactions      map[string][]primitive.ObjectID `bson:"reactions,omitempty" json:"reactions,omitempty"`
-	Pinned         bool                            `bson:"pinned" json:"pinned"`
-	StarredBy      []primitive.ObjectID            `bson:"starredBy" json:"starredBy"`
-	RepliedMessage *RepliedMessageInfo             `bson:"repliedMessage,omitempty" json:"repliedMessage,omitempty"`
+	ID              primitive.ObjectID              `bson:"_id,omitempty" json:"id"`
+	RoomID          primitive.ObjectID              `bson:"roomId" json:"roomId"`
+	SenderID        primitive.ObjectID              `bson:"senderId" json:"senderId"`
+	ReplyTo         *primitive.ObjectID             `bson:"replyTo,omitempty" json:"replyTo,omitempty"`
+	ThreadID        *primitive.ObjectID             `bson:"threadId,omitempty" json:"threadId,omitempty"`
+	Content         string                          `bson:"content" json:"content"`
+	MediaURL        string                          `bson:"mediaUrl,omitempty" json:"mediaUrl,omitempty"`
+	ForwardedFrom   *ForwardOrigin                  `bson:"forwardedFrom,omitempty" json:"forwardedFrom,omitempty"`
+	Mentions        []Mention                       `bson:"mentions,omitempty" json:"mentions,omitempty"`
+	MentionedUsers  []primitive.ObjectID            `bson:"mentionedUsers,omitempty" json:"-"`
+	Timestamp       time.Time                       `bson:"timestamp" json:"timestamp"`
+	EditedAt        *time.Time                      `bson:"editedAt,omitempty" json:"editedAt,omitempty"`
+	Revisions       []Revision                      `bson:"revisions,omitempty" json:"revisions,omitempty"`
+	ReadBy          []primitive.ObjectID            `bson:"readBy" json:"readBy"`
+	ReadPrivately   []primitive.ObjectID            `bson:"readPrivately,omitempty" json:"-"`
+	ReadReceipts    []Receipt                       `bson:"readReceipts,omitempty" json:"-"`
+	DeliveredTo     []Receipt                       `bson:"deliveredTo,omitempty" json:"-"`
+	Reactions       map[string][]primitive.ObjectID `bson:"reactions,omitempty" json:"reactions,omitempty"`
+	Pinned          bool                            `bson:"pinned" json:"pinned"`
+	StarredBy       []primitive.ObjectID            `bson:"starredBy" json:"starredBy"`
+	ReplyCount      int                             `bson:"replyCount,omitempty" json:"replyCount,omitempty"`
+	LastReplyAt     *time.Time                      `bson:"lastReplyAt,omitempty" json:"lastReplyAt,omitempty"`
+	ThreadFollowers []primitive.ObjectID            `bson:"threadFollowers,omitempty" json:"-"`
+	ScheduledID     *primitive.ObjectID             `bson:"scheduledId,omitempty" json:"-"`
+	HiddenFor       []primitive.ObjectID            `bson:"hiddenFor,omitempty" json:"-"`
+	Deleted         bool                            `bson:"deleted,omitempty" json:"deleted,omitempty"`
+	DeletedAt       *time.Time                      `bson:"deletedAt,omitempty" json:"deletedAt,omitempty"`
+	DeletedBy       *primitive.ObjectID             `bson:"deletedBy,omitempty" json:"deletedBy,omitempty"`
+	RepliedMessage  *RepliedMessageInfo             `bson:"repliedMessage,omitempty" json:"repliedMessage,omitempty"`
 }
@@ -7,11 +7,13 @@ import "go.mongodb.org/mongo-driver/bson/primitive"
 // Name is the room name
 // Members is a list of user IDs
 // IsGroup indicates if this is a group chat
+// Admins lists the members with moderation rights, starting with the creator
 type Room struct {
 	ID          primitive.ObjectID   `bson:"_id,omitempty" json:"id"`
 	Name        string               `bson:"name" json:"name"`
 	Members     []primitive.ObjectID `bson:"members" json:"members"`
 	IsGroup     bool                 `bson:"isGroup" json:"isGroup"`
+	Admins      []primitive.ObjectID `bson:"admins,omitempty" json:"admins,omitempty"`
 	Avatar      string               `bson:"avatar,omitempty" json:"avatar,omitempty"`
 	Description string               `bson:"description,omitempty" json:"description,omitempty"`
 }
@@ -0,0 +1,37 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Statuses of a scheduled message
+const (
+	ScheduledPending = "pending"
+	ScheduledSent    = "sent"
+	ScheduledFailed  = "failed"
+)
+
+// ScheduledMessage is a message a user wrote to be sent to a room at SendAt
+// Status stays pending until the scheduler sends it (sent, with MessageID) or gives up (failed, with Error)
+// Claim identifies the scheduler run sending it and ClaimedUntil is that run's lease; after a failed
+// attempt ClaimedUntil is when it may be retried
+type ScheduledMessage struct {
+	ID           primitive.ObjectID  `bson:"_id,omitempty" json:"id"`
+	RoomID       primitive.ObjectID  `bson:"roomId" json:"roomId"`
+	SenderID     primitive.ObjectID  `bson:"senderId" json:"senderId"`
+	Content      string              `bson:"content" json:"content"`
+	MediaURL     string              `bson:"mediaUrl,omitempty" json:"mediaUrl,omitempty"`
+	ReplyTo      *primitive.ObjectID `bson:"replyTo,omitempty" json:"replyTo,omitempty"`
+	ThreadID     *primitive.ObjectID `bson:"threadId,omitempty" json:"threadId,omitempty"`
+	SendAt       time.Time           `bson:"sendAt" json:"sendAt"`
+	Status       string              `bson:"status" json:"status"`
+	Attempts     int                 `bson:"attempts" json:"attempts"`
+	Error        string              `bson:"error,omitempty" json:"error,omitempty"`
+	MessageID    *primitive.ObjectID `bson:"messageId,omitempty" json:"messageId,omitempty"`
+	CreatedAt    time.Time           `bson:"createdAt" json:"createdAt"`
+	UpdatedAt    time.Time           `bson:"updatedAt" json:"updatedAt"`
+	Claim        string              `bson:"claim,omitempty" json:"-"`
+	ClaimedUntil *time.Time          `bson:"claimedUntil,omitempty" json:"-"`
+}
@@ -1,7 +1,15 @@
 package models
 
-import "go.mongodb.org/mongo-driver/bson/primitive"
+import (
+	"time"
 
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// User is a registered account
+// Presence is online, away or offline and LastSeen is when it last changed, both kept by the socket hub;
+// they are never serialized with the user and are only served by the presence endpoint, which checks visibility
+// ReadReceiptsDisabled stops the user's reads from being reported to other members; only the user can see it
 type User struct {
 	ID       primitive.ObjectID   `bson:"_id,omitempty" json:"id"`
 	Username string               `bson:"username" json:"username"`
@@ -10,4 +18,9 @@ type User struct {
 	Avatar   string               `bson:"avatar,omitempty" json:"avatar,omitempty"`
 	About    string               `bson:"about,omitempty" json:"about,omitempty"`
 	Contacts []primitive.ObjectID `bson:"contacts,omitempty" json:"contacts,omitempty"`
+
+	Presence string     `bson:"presence,omitempty" json:"-"`
+	LastSeen *time.Time `bson:"lastSeen,omitempty" json:"-"`
+
+	ReadReceiptsDisabled bool `bson:"readReceiptsDisabled,omitempty" json:"-"`
 }
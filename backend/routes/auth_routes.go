@@ -2,6 +2,7 @@ package routes
 
 import (
 	"line/controllers"
+	"line/middleware"
 
 	"github.com/gin-gonic/gin"
 )
@@ -12,5 +13,8 @@ func AuthRoutes(r *gin.Engine) {
 	r.POST("/login", controllers.Login)
 	r.GET("/users", controllers.GetAllUsers)
 	r.PATCH("/users/:id", controllers.UpdateUserProfile)
+	r.GET("/users/:id/privacy", middleware.JWTAuth(), controllers.GetPrivacySettings)
+	r.PATCH("/users/:id/privacy", middleware.JWTAuth(), controllers.UpdatePrivacySettings)
+	r.GET("/users/presence", middleware.JWTAuth(), controllers.GetPresence)
 	r.POST("/users/:id/avatar", controllers.UploadUserAvatar)
 }
@@ -0,0 +1,15 @@
+package routes
+
+import (
+	"line/metrics"
+	"line/sockets"
+
+	"github.com/gin-gonic/gin"
+)
+
+// InternalRoutes exposes Prometheus metrics and the socket hub counters on the internal listener
+// Neither is authenticated, so the listener must not be reachable from outside
+func InternalRoutes(r *gin.Engine) {
+	r.GET("/metrics", gin.WrapH(metrics.Handler()))
+	r.GET("/ws/stats", sockets.HandleStats)
+}
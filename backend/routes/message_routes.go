@@ -12,6 +12,7 @@ func MessageRoutes(r *gin.Engine) {
 	msg := r.Group("/rooms/:id/messages")
 	msg.Use(middleware.JWTAuth())
 	msg.GET("", controllers.GetRoomMessages)
+	msg.POST("", controllers.SendMessage)
 	msg.POST("/mark-read", controllers.MarkRoomMessagesRead)
 
 	// Message actions (by message ID, not room)
@@ -22,6 +23,16 @@ func MessageRoutes(r *gin.Engine) {
 	m.POST(":msgId/star", controllers.StarMessage)
 	m.POST(":msgId/unstar", controllers.UnstarMessage)
 	m.DELETE(":msgId", controllers.DeleteMessage)
+	m.PATCH(":msgId", controllers.EditMessage)
+	m.GET(":msgId/revisions", controllers.GetMessageRevisions)
 	m.POST(":msgId/forward", controllers.ForwardMessage)
+	m.GET(":msgId/thread", controllers.GetThread)
+	m.POST(":msgId/thread/follow", controllers.FollowThread)
+	m.DELETE(":msgId/thread/follow", controllers.UnfollowThread)
 	m.GET("/starred", controllers.GetStarredMessages)
+	m.GET(":msgId/info", controllers.GetMessageInfo)
+
+	mentions := r.Group("/mentions")
+	mentions.Use(middleware.JWTAuth())
+	mentions.GET("", controllers.GetMentions)
 }
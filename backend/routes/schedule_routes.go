@@ -0,0 +1,18 @@
+package routes
+
+import (
+	"line/controllers"
+	"line/middleware"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ScheduleRoutes sets up the current user's scheduled messages
+func ScheduleRoutes(r *gin.Engine) {
+	scheduled := r.Group("/scheduled")
+	scheduled.Use(middleware.JWTAuth())
+	scheduled.POST("", controllers.ScheduleMessage)
+	scheduled.GET("", controllers.GetScheduledMessages)
+	scheduled.PATCH(":id", controllers.UpdateScheduledMessage)
+	scheduled.DELETE(":id", controllers.CancelScheduledMessage)
+}
@@ -0,0 +1,15 @@
+package routes
+
+import (
+	"line/controllers"
+	"line/middleware"
+
+	"github.com/gin-gonic/gin"
+)
+
+// SearchRoutes sets up search over the current user's messages
+func SearchRoutes(r *gin.Engine) {
+	search := r.Group("/search")
+	search.Use(middleware.JWTAuth())
+	search.GET("/messages", controllers.SearchMessages)
+}
@@ -7,7 +7,10 @@ import (
 	"github.com/gin-gonic/gin"
 )
 
-// WebSocketRoutes sets up the WebSocket endpoint
+// WebSocketRoutes sets up the WebSocket endpoint and its SSE and long-poll fallbacks
 func WebSocketRoutes(r *gin.Engine) {
 	r.GET("/ws", middleware.JWTAuth(), sockets.HandleWebSocket)
+	r.GET("/events", middleware.JWTAuth(), sockets.HandleSSE)
+	r.GET("/poll", middleware.JWTAuth(), sockets.HandlePoll)
+	r.POST("/events/send", middleware.JWTAuth(), sockets.HandleFallbackSend)
 }
@@ -0,0 +1,57 @@
+package services
+
+import "net/http"
+
+// Error is a failed action with a code shared by the REST and socket APIs
+// Status is the HTTP status the REST controllers answer with
+type Error struct {
+	code   string
+	status int
+	msg    string
+}
+
+func (e *Error) Error() string { return e.msg }
+
+// Code returns the machine readable error code, e.g. "forbidden"
+func (e *Error) Code() string { return e.code }
+
+// Status returns the HTTP status matching the error
+func (e *Error) Status() int { return e.status }
+
+func badRequest(msg string) *Error {
+	return &Error{code: "bad_request", status: http.StatusBadRequest, msg: msg}
+}
+
+func notFound(msg string) *Error {
+	return &Error{code: "not_found", status: http.StatusNotFound, msg: msg}
+}
+
+func forbidden(msg string) *Error {
+	return &Error{code: "forbidden", status: http.StatusForbidden, msg: msg}
+}
+
+// notMember, notSender and notSenderOrAdmin are the denials of the authorization policy
+func notMember(msg string) *Error {
+	return &Error{code: "not_member", status: http.StatusForbidden, msg: msg}
+}
+
+func notSender(msg string) *Error {
+	return &Error{code: "not_sender", status: http.StatusForbidden, msg: msg}
+}
+
+func notSenderOrAdmin(msg string) *Error {
+	return &Error{code: "not_sender_or_admin", status: http.StatusForbidden, msg: msg}
+}
+
+func internal(msg string) *Error {
+	return &Error{code: "internal", status: http.StatusInternalServerError, msg: msg}
+}
+
+func conflict(msg string) *Error {
+	return &Error{code: "conflict", status: http.StatusConflict, msg: msg}
+}
+
+// windowClosed refuses an action whose time limit has passed
+func windowClosed(msg string) *Error {
+	return &Error{code: "window_closed", status: http.StatusForbidden, msg: msg}
+}
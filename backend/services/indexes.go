@@ -0,0 +1,44 @@
+package services
+
+import (
+	"context"
+	"line/config"
+	"log"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// EnsureIndexes creates the indexes the message service and the scheduler rely on
+// History pages walk a room, a thread or a user's mentions in (timestamp, _id) order and search uses the
+// text index on content
+func EnsureIndexes() {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	_, err := config.DB.Collection("messages").Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "roomId", Value: 1}, {Key: "timestamp", Value: 1}, {Key: "_id", Value: 1}}},
+		{Keys: bson.D{{Key: "threadId", Value: 1}, {Key: "timestamp", Value: 1}, {Key: "_id", Value: 1}}},
+		{Keys: bson.D{{Key: "mentionedUsers", Value: 1}, {Key: "timestamp", Value: -1}, {Key: "_id", Value: -1}}},
+		{Keys: bson.D{{Key: "content", Value: "text"}}},
+	})
+	if err != nil {
+		log.Println("Could not create indexes for messages:", err)
+	}
+	// A scheduled message can become at most one message, even when a send is retried
+	_, err = config.DB.Collection("messages").Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "scheduledId", Value: 1}},
+		Options: options.Index().SetUnique(true).SetPartialFilterExpression(bson.M{"scheduledId": bson.M{"$exists": true}}),
+	})
+	if err != nil {
+		log.Println("Could not create the scheduledId index for messages:", err)
+	}
+	_, err = scheduledCollection().Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "status", Value: 1}, {Key: "sendAt", Value: 1}}},
+		{Keys: bson.D{{Key: "senderId", Value: 1}, {Key: "sendAt", Value: 1}}},
+	})
+	if err != nil {
+		log.Println("Could not create indexes for scheduled messages:", err)
+	}
+}
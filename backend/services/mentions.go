@@ -0,0 +1,199 @@
+package services
+
+import (
+	"context"
+	"line/config"
+	"line/models"
+	"line/sockets"
+	"strings"
+	"unicode"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// MentionQuery selects a page of the current user's mentions inbox
+// Before takes the NextCursor of an earlier page; Unread keeps only mentions the user has not read
+type MentionQuery struct {
+	Before string
+	Limit  int
+	Unread bool
+}
+
+// MentionPage is a page of messages mentioning the user, newest first
+// NextCursor loads older mentions when passed as before and is empty when there are none
+type MentionPage struct {
+	Messages   []models.Message `json:"messages"`
+	HasMore    bool             `json:"hasMore"`
+	NextCursor string           `json:"nextCursor,omitempty"`
+}
+
+// isMentionRune reports whether r can be part of the name after an "@"
+func isMentionRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_' || r == '.' || r == '-'
+}
+
+// parseMentions finds the @username and @all mentions in content and resolves them against the room's members
+// A name matches a member's username exactly, or ignoring case when only one member matches that way.
+// Names that match nobody in the room are left as plain text. The sender is never among the mentioned users
+func parseMentions(ctx context.Context, roomID, senderID primitive.ObjectID, content string) ([]models.Mention, []primitive.ObjectID, error) {
+	type candidate struct {
+		name           string
+		offset, length int
+	}
+	text := []rune(content)
+	var candidates []candidate
+	for i := 0; i < len(text); i++ {
+		if text[i] != '@' || (i > 0 && isMentionRune(text[i-1])) {
+			continue
+		}
+		end := i + 1
+		for end < len(text) && isMentionRune(text[end]) {
+			end++
+		}
+		// Punctuation ending a sentence is not part of the name
+		for end > i+1 && strings.ContainsRune(".-", text[end-1]) {
+			end--
+		}
+		if end > i+1 {
+			candidates = append(candidates, candidate{name: string(text[i+1 : end]), offset: i, length: end - i})
+		}
+		i = end - 1
+	}
+	if len(candidates) == 0 {
+		return nil, nil, nil
+	}
+
+	var room models.Room
+	if err := config.DB.Collection("rooms").FindOne(ctx, bson.M{"_id": roomID}).Decode(&room); err != nil {
+		return nil, nil, notFound("Room not found")
+	}
+	cursor, err := config.DB.Collection("users").Find(ctx, bson.M{"_id": bson.M{"$in": room.Members}}, options.Find().SetProjection(bson.M{"username": 1}))
+	if err != nil {
+		return nil, nil, internal("DB error")
+	}
+	var members []models.User
+	if err := cursor.All(ctx, &members); err != nil {
+		return nil, nil, internal("DB error")
+	}
+	resolve := func(name string) *models.User {
+		var folded *models.User
+		matches := 0
+		for i := range members {
+			if members[i].Username == name {
+				return &members[i]
+			}
+			if strings.EqualFold(members[i].Username, name) {
+				folded = &members[i]
+				matches++
+			}
+		}
+		if matches == 1 {
+			return folded
+		}
+		return nil
+	}
+
+	var mentions []models.Mention
+	var users []primitive.ObjectID
+	seen := map[primitive.ObjectID]bool{senderID: true}
+	notify := func(id primitive.ObjectID) {
+		if !seen[id] {
+			seen[id] = true
+			users = append(users, id)
+		}
+	}
+	for _, c := range candidates {
+		if member := resolve(c.name); member != nil {
+			id := member.ID
+			mentions = append(mentions, models.Mention{Type: models.MentionUser, UserID: &id, Username: member.Username, Offset: c.offset, Length: c.length})
+			notify(id)
+			continue
+		}
+		if strings.EqualFold(c.name, "all") {
+			mentions = append(mentions, models.Mention{Type: models.MentionAll, Offset: c.offset, Length: c.length})
+			for _, id := range room.Members {
+				notify(id)
+			}
+		}
+	}
+	return mentions, users, nil
+}
+
+// notifyMentions sends a mention event for msg to the given users
+func notifyMentions(msg models.Message, users []primitive.ObjectID) {
+	if len(users) == 0 {
+		return
+	}
+	to := make([]string, 0, len(users))
+	for _, id := range users {
+		to = append(to, id.Hex())
+	}
+	event := sockets.MentionEvent{
+		Type:      "mention",
+		RoomID:    msg.RoomID.Hex(),
+		MessageID: msg.ID.Hex(),
+		SenderID:  msg.SenderID.Hex(),
+		Content:   msg.Content,
+		Timestamp: msg.Timestamp,
+		To:        to,
+	}
+	if msg.ThreadID != nil {
+		event.ThreadID = msg.ThreadID.Hex()
+	}
+	sockets.H.Mention <- event
+}
+
+// Mentions returns a page of the messages that mention the user in rooms they still belong to
+// Messages deleted for everyone or hidden by the user are left out
+func (MessageService) Mentions(ctx context.Context, userID string, q MentionQuery) (MentionPage, error) {
+	uid, err := parseID(userID, "user")
+	if err != nil {
+		return MentionPage{}, err
+	}
+	limit := q.Limit
+	if limit <= 0 {
+		limit = DefaultPageSize
+	}
+	if limit > MaxPageSize {
+		limit = MaxPageSize
+	}
+	rooms, err := userRooms(ctx, uid)
+	if err != nil {
+		return MentionPage{}, err
+	}
+	roomIDs := make([]primitive.ObjectID, 0, len(rooms))
+	for id := range rooms {
+		roomIDs = append(roomIDs, id)
+	}
+	base := bson.M{
+		"mentionedUsers": uid,
+		"roomId":         bson.M{"$in": roomIDs},
+		"hiddenFor":      bson.M{"$ne": uid},
+		"deleted":        bson.M{"$ne": true},
+	}
+	if q.Unread {
+		base["$nor"] = unreadFilter(uid)
+	}
+	var bound bson.M
+	if q.Before != "" {
+		p, err := parseCursor(q.Before)
+		if err != nil {
+			return MentionPage{}, err
+		}
+		bound = olderThan(p, false)
+	}
+	messages, hasMore, err := fetchMessages(ctx, base, bound, -1, limit)
+	if err != nil {
+		return MentionPage{}, err
+	}
+	page := MentionPage{Messages: messages, HasMore: hasMore}
+	if page.Messages == nil {
+		page.Messages = []models.Message{}
+	}
+	if hasMore {
+		page.NextCursor = encodeCursor(positionOf(messages[len(messages)-1]))
+	}
+	return page, nil
+}
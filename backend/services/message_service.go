@@ -0,0 +1,702 @@
+package services
+
+import (
+	"context"
+	"line/config"
+	"line/models"
+	"line/sockets"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// MessageService implements the message actions shared by the REST controllers and the socket
+// Every action validates its input, updates MongoDB and emits the matching Hub event
+type MessageService struct{}
+
+// Messages is the service used by the controllers and wired into the socket layer in main
+var Messages = MessageService{}
+
+// parseID converts a hex ID, failing with a bad request naming what the ID was for
+func parseID(hex, what string) (primitive.ObjectID, error) {
+	id, err := primitive.ObjectIDFromHex(hex)
+	if err != nil {
+		return id, badRequest("Invalid " + what + " ID")
+	}
+	return id, nil
+}
+
+// findMessage loads a message by ID
+func findMessage(ctx context.Context, id primitive.ObjectID) (models.Message, error) {
+	var msg models.Message
+	err := config.DB.Collection("messages").FindOne(ctx, bson.M{"_id": id}).Decode(&msg)
+	if err != nil {
+		return msg, notFound("Message not found")
+	}
+	return msg, nil
+}
+
+// findLiveMessage loads a message that has not been deleted for everyone
+func findLiveMessage(ctx context.Context, id primitive.ObjectID) (models.Message, error) {
+	msg, err := findMessage(ctx, id)
+	if err != nil {
+		return msg, err
+	}
+	if msg.Deleted {
+		return msg, badRequest("Message was deleted")
+	}
+	return msg, nil
+}
+
+// replyTarget resolves the message a new message in the room replies to
+// A message of another room is reported as not found, so replies cannot reveal it
+func replyTarget(ctx context.Context, roomID primitive.ObjectID, replyTo string) (primitive.ObjectID, error) {
+	id, err := parseID(replyTo, "reply")
+	if err != nil {
+		return id, err
+	}
+	target, err := findMessage(ctx, id)
+	if err != nil || target.RoomID != roomID {
+		return id, notFound("Replied message not found")
+	}
+	return id, nil
+}
+
+// Send stores a new message from the user and broadcasts it to the room
+// A message with a ThreadID is a thread reply: it updates the root's summary and goes out as a thread event
+// Members named with @username or @all get a mention event wherever they are connected
+func (MessageService) Send(ctx context.Context, userID string, req sockets.MessageRequest) (sockets.MessageEvent, error) {
+	rid, err := parseID(req.RoomID, "room")
+	if err != nil {
+		return sockets.MessageEvent{}, err
+	}
+	sid, err := parseID(userID, "user")
+	if err != nil {
+		return sockets.MessageEvent{}, err
+	}
+	if req.Content == "" && req.MediaURL == "" {
+		return sockets.MessageEvent{}, badRequest("Message has no content")
+	}
+	if err := requireMember(rid, userID); err != nil {
+		return sockets.MessageEvent{}, err
+	}
+
+	newMsg := models.Message{
+		RoomID:    rid,
+		SenderID:  sid,
+		Content:   req.Content,
+		MediaURL:  req.MediaURL,
+		Timestamp: time.Now(),
+		ReadBy:    []primitive.ObjectID{},
+		Reactions: map[string][]primitive.ObjectID{},
+	}
+
+	if req.ReplyTo != "" {
+		replyToID, err := replyTarget(ctx, rid, req.ReplyTo)
+		if err != nil {
+			return sockets.MessageEvent{}, err
+		}
+		newMsg.ReplyTo = &replyToID
+	}
+	var root models.Message
+	if req.ThreadID != "" {
+		if root, err = threadRoot(ctx, rid, req.ThreadID); err != nil {
+			return sockets.MessageEvent{}, err
+		}
+		newMsg.ThreadID = &root.ID
+	}
+	if req.ScheduledID != "" {
+		scheduledID, err := parseID(req.ScheduledID, "scheduled message")
+		if err != nil {
+			return sockets.MessageEvent{}, err
+		}
+		newMsg.ScheduledID = &scheduledID
+	}
+	mentioned := []primitive.ObjectID{}
+	if req.Content != "" {
+		if newMsg.Mentions, mentioned, err = parseMentions(ctx, rid, sid, req.Content); err != nil {
+			return sockets.MessageEvent{}, err
+		}
+		newMsg.MentionedUsers = mentioned
+	}
+
+	res, err := config.DB.Collection("messages").InsertOne(ctx, newMsg)
+	if err != nil {
+		return sockets.MessageEvent{}, internal("Could not save message")
+	}
+	newMsgID := res.InsertedID.(primitive.ObjectID)
+
+	// Use aggregation to fetch the full message details to ensure consistency
+	pipeline := append([]bson.M{
+		{"$match": bson.M{"_id": newMsgID}},
+		{"$limit": 1},
+	}, ReplyLookup()...)
+
+	cursor, err := config.DB.Collection("messages").Aggregate(ctx, pipeline)
+	if err != nil {
+		return sockets.MessageEvent{}, internal("Could not load saved message")
+	}
+	var fullMessages []models.Message
+	if err = cursor.All(ctx, &fullMessages); err != nil || len(fullMessages) == 0 {
+		return sockets.MessageEvent{}, internal("Could not load saved message")
+	}
+	fullMessage := fullMessages[0]
+
+	// Create message event for broadcast
+	msgEvent := sockets.MessageEvent{
+		Type:           "message",
+		ID:             fullMessage.ID.Hex(),
+		ClientSideID:   req.ClientSideID,
+		RoomID:         fullMessage.RoomID.Hex(),
+		SenderID:       fullMessage.SenderID.Hex(),
+		Content:        fullMessage.Content,
+		MediaURL:       fullMessage.MediaURL,
+		Mentions:       fullMessage.Mentions,
+		Timestamp:      fullMessage.Timestamp,
+		RepliedMessage: fullMessage.RepliedMessage,
+	}
+	if fullMessage.ReplyTo != nil {
+		msgEvent.ReplyTo = fullMessage.ReplyTo.Hex()
+	}
+
+	if newMsg.ThreadID != nil {
+		msgEvent.ThreadID = root.ID.Hex()
+		thread, err := addThreadReply(ctx, root, fullMessage)
+		if err != nil {
+			return sockets.MessageEvent{}, err
+		}
+		thread.Reply = msgEvent
+		sockets.H.Thread <- thread
+	} else {
+		sockets.H.Broadcast <- msgEvent
+	}
+	notifyMentions(fullMessage, mentioned)
+	// Sending ends the sender's typing state without waiting for it to expire
+	sockets.H.Typing <- sockets.TypingEvent{Type: "typing_stop", RoomID: msgEvent.RoomID, UserID: userID}
+	return msgEvent, nil
+}
+
+// React toggles the user's emoji reaction on a message
+func (MessageService) React(ctx context.Context, userID, messageID, emoji string) error {
+	if emoji == "" {
+		return badRequest("emoji is required")
+	}
+	mid, err := parseID(messageID, "message")
+	if err != nil {
+		return err
+	}
+	uid, err := parseID(userID, "user")
+	if err != nil {
+		return err
+	}
+	msg, err := findLiveMessage(ctx, mid)
+	if err != nil {
+		return err
+	}
+	if err := authorize(ctx, ActionReact, userID, msg); err != nil {
+		return err
+	}
+	if msg.Reactions == nil {
+		msg.Reactions = make(map[string][]primitive.ObjectID)
+	}
+	found := false
+	for _, id := range msg.Reactions[emoji] {
+		if id == uid {
+			found = true
+			break
+		}
+	}
+	if !found {
+		msg.Reactions[emoji] = append(msg.Reactions[emoji], uid)
+	} else {
+		// Remove reaction
+		newArr := []primitive.ObjectID{}
+		for _, id := range msg.Reactions[emoji] {
+			if id != uid {
+				newArr = append(newArr, id)
+			}
+		}
+		if len(newArr) == 0 {
+			delete(msg.Reactions, emoji)
+		} else {
+			msg.Reactions[emoji] = newArr
+		}
+	}
+	_, err = config.DB.Collection("messages").UpdateOne(ctx, bson.M{"_id": mid}, bson.M{"$set": bson.M{"reactions": msg.Reactions}})
+	if err != nil {
+		return internal("Could not save reaction")
+	}
+	sockets.H.Reaction <- sockets.ReactionEvent{
+		Type:      "reaction",
+		RoomID:    msg.RoomID.Hex(),
+		MessageID: messageID,
+		Emoji:     emoji,
+		UserID:    userID,
+	}
+	return nil
+}
+
+// setPinned pins or unpins a message and emits a pin or unpin event
+func setPinned(ctx context.Context, userID, messageID string, pinned bool) error {
+	id, err := parseID(messageID, "message")
+	if err != nil {
+		return err
+	}
+	current, err := findLiveMessage(ctx, id)
+	if err != nil {
+		return err
+	}
+	if err := authorize(ctx, ActionPin, userID, current); err != nil {
+		return err
+	}
+	_, err = config.DB.Collection("messages").UpdateByID(ctx, id, bson.M{"$set": bson.M{"pinned": pinned}})
+	if err != nil {
+		return internal("DB error")
+	}
+	msg, err := findMessage(ctx, id)
+	if err != nil {
+		return err
+	}
+	eventType := "pin"
+	if !pinned {
+		eventType = "unpin"
+	}
+	sockets.H.Pin <- sockets.PinEvent{Type: eventType, RoomID: msg.RoomID.Hex(), MessageID: messageID, Message: msg}
+	return nil
+}
+
+// Pin marks a message as pinned in its room
+func (MessageService) Pin(ctx context.Context, userID, messageID string) error {
+	return setPinned(ctx, userID, messageID, true)
+}
+
+// Unpin removes the pinned mark from a message
+func (MessageService) Unpin(ctx context.Context, userID, messageID string) error {
+	return setPinned(ctx, userID, messageID, false)
+}
+
+// setStarred adds or removes the user from a message's starredBy and emits a star or unstar event
+func setStarred(ctx context.Context, userID, messageID string, starred bool) error {
+	uid, err := parseID(userID, "user")
+	if err != nil {
+		return err
+	}
+	id, err := parseID(messageID, "message")
+	if err != nil {
+		return err
+	}
+	current, err := findLiveMessage(ctx, id)
+	if err != nil {
+		return err
+	}
+	if err := authorize(ctx, ActionStar, userID, current); err != nil {
+		return err
+	}
+	update := bson.M{"$addToSet": bson.M{"starredBy": uid}}
+	eventType := "star"
+	if !starred {
+		update = bson.M{"$pull": bson.M{"starredBy": uid}}
+		eventType = "unstar"
+	}
+	_, err = config.DB.Collection("messages").UpdateByID(ctx, id, update)
+	if err != nil {
+		return internal("DB error")
+	}
+	msg, err := findMessage(ctx, id)
+	if err != nil {
+		return err
+	}
+	sockets.H.Star <- sockets.StarEvent{Type: eventType, RoomID: msg.RoomID.Hex(), MessageID: messageID, Message: msg}
+	return nil
+}
+
+// Star adds a message to the user's starred messages
+func (MessageService) Star(ctx context.Context, userID, messageID string) error {
+	return setStarred(ctx, userID, messageID, true)
+}
+
+// Unstar removes a message from the user's starred messages
+func (MessageService) Unstar(ctx context.Context, userID, messageID string) error {
+	return setStarred(ctx, userID, messageID, false)
+}
+
+// Delete deletes a message for everyone, leaving a tombstone, and emits a delete event to its room
+// Only the sender or a room admin may do so, within Opts.DeleteWindow of sending; deleting a tombstone is a no-op
+// A deleted thread reply no longer counts toward its root's replyCount and lastReplyAt
+func (MessageService) Delete(ctx context.Context, userID, messageID string) error {
+	id, err := parseID(messageID, "message")
+	if err != nil {
+		return err
+	}
+	uid, err := parseID(userID, "user")
+	if err != nil {
+		return err
+	}
+	msg, err := findMessage(ctx, id)
+	if err != nil {
+		return err
+	}
+	if err := authorize(ctx, ActionDelete, userID, msg); err != nil {
+		return err
+	}
+	if msg.Deleted {
+		return nil
+	}
+	if !withinWindow(msg.Timestamp, Opts.DeleteWindow) {
+		return windowClosed("This message can no longer be deleted for everyone")
+	}
+	now := time.Now()
+	res, err := config.DB.Collection("messages").UpdateOne(ctx, bson.M{"_id": id, "deleted": bson.M{"$ne": true}}, bson.M{
+		"$set":   bson.M{"deleted": true, "deletedAt": now, "deletedBy": uid, "content": "", "pinned": false, "starredBy": []primitive.ObjectID{}},
+		"$unset": bson.M{"mediaUrl": "", "reactions": "", "revisions": "", "editedAt": "", "mentions": "", "mentionedUsers": ""},
+	})
+	if err != nil {
+		return internal("DB error")
+	}
+	// Only the delete that made the tombstone updates the thread, so a racing delete cannot count it twice
+	if res.ModifiedCount > 0 && msg.ThreadID != nil {
+		if err := removeThreadReply(ctx, *msg.ThreadID); err != nil {
+			return err
+		}
+	}
+	sockets.H.Delete <- sockets.DeleteEvent{Type: "delete", Scope: sockets.DeleteForEveryone, RoomID: msg.RoomID.Hex(), MessageID: messageID, DeletedBy: userID}
+	return nil
+}
+
+// Hide deletes a message for the user only and tells their other devices
+func (MessageService) Hide(ctx context.Context, userID, messageID string) error {
+	id, err := parseID(messageID, "message")
+	if err != nil {
+		return err
+	}
+	uid, err := parseID(userID, "user")
+	if err != nil {
+		return err
+	}
+	msg, err := findMessage(ctx, id)
+	if err != nil {
+		return err
+	}
+	if err := authorize(ctx, ActionHide, userID, msg); err != nil {
+		return err
+	}
+	_, err = config.DB.Collection("messages").UpdateByID(ctx, id, bson.M{"$addToSet": bson.M{"hiddenFor": uid}})
+	if err != nil {
+		return internal("DB error")
+	}
+	sockets.H.SendToUser(userID, "delete", sockets.DeleteEvent{Type: "delete", Scope: sockets.DeleteForMe, RoomID: msg.RoomID.Hex(), MessageID: messageID})
+	return nil
+}
+
+// Edit replaces the content of a message and emits an edit event to its room
+// Only the sender may edit, and only within Opts.EditWindow of sending; the replaced content is kept in Revisions
+// Mentions are parsed again from the new content
+func (MessageService) Edit(ctx context.Context, userID, messageID, content string) (models.Message, error) {
+	id, err := parseID(messageID, "message")
+	if err != nil {
+		return models.Message{}, err
+	}
+	msg, err := findLiveMessage(ctx, id)
+	if err != nil {
+		return models.Message{}, err
+	}
+	if err := authorize(ctx, ActionEdit, userID, msg); err != nil {
+		return models.Message{}, err
+	}
+	if !withinWindow(msg.Timestamp, Opts.EditWindow) {
+		return models.Message{}, windowClosed("This message can no longer be edited")
+	}
+	if content == "" && msg.MediaURL == "" {
+		return models.Message{}, badRequest("Message has no content")
+	}
+	if content == msg.Content {
+		return msg, nil
+	}
+
+	mentions, mentioned, err := parseMentions(ctx, msg.RoomID, msg.SenderID, content)
+	if err != nil {
+		return models.Message{}, err
+	}
+	written := msg.Timestamp
+	if msg.EditedAt != nil {
+		written = *msg.EditedAt
+	}
+	now := time.Now()
+	// Matching the old content makes a concurrent edit fail instead of losing a revision
+	res, err := config.DB.Collection("messages").UpdateOne(ctx,
+		bson.M{"_id": id, "content": msg.Content},
+		bson.M{
+			"$set":  bson.M{"content": content, "editedAt": now, "mentions": mentions, "mentionedUsers": mentioned},
+			"$push": bson.M{"revisions": models.Revision{Content: msg.Content, At: written}},
+		})
+	if err != nil {
+		return models.Message{}, internal("DB error")
+	}
+	if res.MatchedCount == 0 {
+		return models.Message{}, conflict("The message was changed by another edit")
+	}
+	// Only users the edit newly mentions are notified
+	previously := map[primitive.ObjectID]bool{}
+	for _, id := range msg.MentionedUsers {
+		previously[id] = true
+	}
+	added := []primitive.ObjectID{}
+	for _, id := range mentioned {
+		if !previously[id] {
+			added = append(added, id)
+		}
+	}
+	msg.Revisions = append(msg.Revisions, models.Revision{Content: msg.Content, At: written})
+	msg.Content = content
+	msg.EditedAt = &now
+	msg.Mentions = mentions
+	msg.MentionedUsers = mentioned
+
+	sockets.H.Edit <- sockets.EditEvent{Type: "edit", RoomID: msg.RoomID.Hex(), MessageID: messageID, Content: content, Mentions: mentions, EditedAt: now}
+	notifyMentions(msg, added)
+	return msg, nil
+}
+
+// Revisions returns the edit history of a message, oldest first, to a member of its room
+func (MessageService) Revisions(ctx context.Context, userID, messageID string) ([]models.Revision, error) {
+	id, err := parseID(messageID, "message")
+	if err != nil {
+		return nil, err
+	}
+	msg, err := findMessage(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if err := authorize(ctx, ActionView, userID, msg); err != nil {
+		return nil, err
+	}
+	if msg.Revisions == nil {
+		return []models.Revision{}, nil
+	}
+	return msg.Revisions, nil
+}
+
+// Forward copies a message into another room as the forwarding user and emits a forward event there
+// The copy records the original message and its sender in ForwardedFrom
+func (MessageService) Forward(ctx context.Context, userID, messageID, toRoomID string) (models.Message, error) {
+	uid, err := parseID(userID, "user")
+	if err != nil {
+		return models.Message{}, err
+	}
+	id, err := parseID(messageID, "message")
+	if err != nil {
+		return models.Message{}, err
+	}
+	toRoom, err := parseID(toRoomID, "room")
+	if err != nil {
+		return models.Message{}, err
+	}
+	orig, err := findLiveMessage(ctx, id)
+	if err != nil {
+		return models.Message{}, notFound("Original message not found")
+	}
+	if err := authorize(ctx, ActionForward, userID, orig); err != nil {
+		return models.Message{}, err
+	}
+	if err := requireMember(toRoom, userID); err != nil {
+		return models.Message{}, err
+	}
+	// Forwarding a forward keeps pointing at the message it all started from
+	origin := orig.ForwardedFrom
+	if origin == nil {
+		origin = &models.ForwardOrigin{MessageID: orig.ID, SenderID: orig.SenderID}
+	}
+	newMsg := models.Message{
+		RoomID:        toRoom,
+		SenderID:      uid,
+		Content:       orig.Content,
+		MediaURL:      orig.MediaURL,
+		ForwardedFrom: origin,
+		Timestamp:     time.Now(),
+		ReadBy:        []primitive.ObjectID{},
+		Reactions:     map[string][]primitive.ObjectID{},
+		Pinned:        false,
+		StarredBy:     []primitive.ObjectID{},
+	}
+	res, err := config.DB.Collection("messages").InsertOne(ctx, newMsg)
+	if err != nil {
+		return models.Message{}, internal("DB error")
+	}
+	newMsg.ID = res.InsertedID.(primitive.ObjectID)
+	sockets.H.Forward <- sockets.ForwardEvent{Type: "forward", RoomID: toRoomID, MessageID: newMsg.ID.Hex(), Message: newMsg}
+	return newMsg, nil
+}
+
+// MarkRead marks every message of a room up to the latest one as read by the user
+// Room members get a read event naming the latest message, unless the user turned read receipts off
+func (MessageService) MarkRead(ctx context.Context, userID, roomID string) error {
+	uid, err := parseID(userID, "user")
+	if err != nil {
+		return err
+	}
+	rid, err := parseID(roomID, "room")
+	if err != nil {
+		return err
+	}
+	if err := requireMember(rid, userID); err != nil {
+		return err
+	}
+	var reader models.User
+	if err := config.DB.Collection("users").FindOne(ctx, bson.M{"_id": uid}).Decode(&reader); err != nil {
+		return notFound("User not found")
+	}
+
+	var latest models.Message
+	opts := options.FindOne().SetSort(bson.D{{Key: "timestamp", Value: -1}, {Key: "_id", Value: -1}})
+	err = config.DB.Collection("messages").FindOne(ctx, bson.M{"roomId": rid}, opts).Decode(&latest)
+	if err == mongo.ErrNoDocuments {
+		return nil
+	}
+	if err != nil {
+		return internal("DB error")
+	}
+
+	now := time.Now()
+	// Users without read receipts are kept out of the public readBy list; readPrivately only drives unread counts
+	update := bson.M{"$addToSet": bson.M{"readPrivately": uid}}
+	if !reader.ReadReceiptsDisabled {
+		update = bson.M{
+			"$addToSet": bson.M{"readBy": uid},
+			"$push":     bson.M{"readReceipts": models.Receipt{UserID: uid, At: now}},
+		}
+	}
+	// Messages that arrive while marking stay unread, so the up-to ID in the event is exact
+	filter := bson.M{"roomId": rid, "$nor": unreadFilter(uid), "timestamp": bson.M{"$lte": latest.Timestamp}}
+	res, err := config.DB.Collection("messages").UpdateMany(ctx, filter, update)
+	if err != nil {
+		return internal("DB error")
+	}
+	if res.ModifiedCount > 0 && !reader.ReadReceiptsDisabled {
+		sockets.H.Read <- sockets.ReadEvent{Type: "read", RoomID: roomID, UserID: userID, UpToMessageID: latest.ID.Hex(), At: now}
+	}
+	return nil
+}
+
+// unreadFilter matches, under $nor, the messages the user has read with or without a receipt
+func unreadFilter(uid primitive.ObjectID) bson.A {
+	return bson.A{bson.M{"readBy": uid}, bson.M{"readPrivately": uid}}
+}
+
+// MarkDelivered records that the given messages reached a device of the user
+// Each sender gets one delivered event per room listing the messages that were newly delivered
+func (MessageService) MarkDelivered(ctx context.Context, userID string, messageIDs []string) error {
+	uid, err := parseID(userID, "user")
+	if err != nil {
+		return err
+	}
+	if len(messageIDs) == 0 {
+		return badRequest("messageIds is required")
+	}
+	ids := make([]primitive.ObjectID, 0, len(messageIDs))
+	for _, messageID := range messageIDs {
+		id, err := parseID(messageID, "message")
+		if err != nil {
+			return err
+		}
+		ids = append(ids, id)
+	}
+
+	cursor, err := config.DB.Collection("messages").Find(ctx, bson.M{"_id": bson.M{"$in": ids}, "senderId": bson.M{"$ne": uid}})
+	if err != nil {
+		return internal("DB error")
+	}
+	var messages []models.Message
+	if err := cursor.All(ctx, &messages); err != nil {
+		return internal("DB error")
+	}
+
+	now := time.Now()
+	type target struct{ roomID, senderID string }
+	delivered := map[target][]string{}
+	for _, msg := range messages {
+		if err := authorize(ctx, ActionView, userID, msg); err != nil {
+			return err
+		}
+		// The filter makes the update a no-op when another device of the user acked first
+		res, err := config.DB.Collection("messages").UpdateOne(ctx,
+			bson.M{"_id": msg.ID, "deliveredTo.userId": bson.M{"$ne": uid}},
+			bson.M{"$push": bson.M{"deliveredTo": models.Receipt{UserID: uid, At: now}}})
+		if err != nil {
+			return internal("DB error")
+		}
+		if res.ModifiedCount > 0 {
+			key := target{roomID: msg.RoomID.Hex(), senderID: msg.SenderID.Hex()}
+			delivered[key] = append(delivered[key], msg.ID.Hex())
+		}
+	}
+	for key, ids := range delivered {
+		sockets.H.Delivered <- sockets.DeliveredEvent{Type: "delivered", RoomID: key.roomID, SenderID: key.senderID, UserID: userID, MessageIDs: ids, At: now}
+	}
+	return nil
+}
+
+// MemberReceipt is the delivery and read state of a message for one room member
+type MemberReceipt struct {
+	UserID      string     `json:"userId"`
+	Username    string     `json:"username"`
+	DeliveredAt *time.Time `json:"deliveredAt"`
+	ReadAt      *time.Time `json:"readAt"`
+}
+
+// Info lists, for every room member other than the sender, when the message was delivered and read
+func (MessageService) Info(ctx context.Context, userID, messageID string) ([]MemberReceipt, error) {
+	id, err := parseID(messageID, "message")
+	if err != nil {
+		return nil, err
+	}
+	msg, err := findMessage(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if err := authorize(ctx, ActionView, userID, msg); err != nil {
+		return nil, err
+	}
+	var room models.Room
+	if err := config.DB.Collection("rooms").FindOne(ctx, bson.M{"_id": msg.RoomID}).Decode(&room); err != nil {
+		return nil, notFound("Room not found")
+	}
+	cursor, err := config.DB.Collection("users").Find(ctx, bson.M{"_id": bson.M{"$in": room.Members}})
+	if err != nil {
+		return nil, internal("DB error")
+	}
+	var users []models.User
+	if err := cursor.All(ctx, &users); err != nil {
+		return nil, internal("DB error")
+	}
+
+	receiptAt := func(receipts []models.Receipt, uid primitive.ObjectID) *time.Time {
+		for _, r := range receipts {
+			if r.UserID == uid {
+				at := r.At
+				return &at
+			}
+		}
+		return nil
+	}
+	result := []MemberReceipt{}
+	for _, user := range users {
+		if user.ID == msg.SenderID {
+			continue
+		}
+		info := MemberReceipt{
+			UserID:      user.ID.Hex(),
+			Username:    user.Username,
+			DeliveredAt: receiptAt(msg.DeliveredTo, user.ID),
+			ReadAt:      receiptAt(msg.ReadReceipts, user.ID),
+		}
+		// Reading implies delivery, even when the device never sent a delivered ack
+		if info.DeliveredAt == nil && info.ReadAt != nil {
+			info.DeliveredAt = info.ReadAt
+		}
+		result = append(result, info)
+	}
+	return result, nil
+}
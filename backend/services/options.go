@@ -0,0 +1,48 @@
+package services
+
+import (
+	"line/config"
+	"log"
+	"time"
+)
+
+// Options holds the rules of the message actions
+// EditWindow is how long after sending a message its sender may still edit it; 0 means no limit
+// DeleteWindow is how long after sending a message it may still be deleted for everyone; 0 means no limit
+// ScheduleInterval is how often the scheduler looks for scheduled messages that are due
+// ScheduleLease is how long an instance holds a scheduled message it is sending before another may retry it
+type Options struct {
+	EditWindow       time.Duration
+	DeleteWindow     time.Duration
+	ScheduleInterval time.Duration
+	ScheduleLease    time.Duration
+}
+
+// Opts are the options in effect, replaced by LoadOptions at startup
+var Opts = Options{
+	EditWindow:       15 * time.Minute,
+	DeleteWindow:     48 * time.Hour,
+	ScheduleInterval: 5 * time.Second,
+	ScheduleLease:    time.Minute,
+}
+
+// LoadOptions reads the service options from the environment
+func LoadOptions() {
+	Opts.EditWindow = config.GetEnvDuration("MESSAGE_EDIT_WINDOW", Opts.EditWindow)
+	Opts.DeleteWindow = config.GetEnvDuration("MESSAGE_DELETE_WINDOW", Opts.DeleteWindow)
+	if interval := config.GetEnvDuration("SCHEDULE_INTERVAL", Opts.ScheduleInterval); interval > 0 {
+		Opts.ScheduleInterval = interval
+	} else {
+		log.Printf("SCHEDULE_INTERVAL must be positive, using %s", Opts.ScheduleInterval)
+	}
+	if lease := config.GetEnvDuration("SCHEDULE_LEASE", Opts.ScheduleLease); lease > 0 {
+		Opts.ScheduleLease = lease
+	} else {
+		log.Printf("SCHEDULE_LEASE must be positive, using %s", Opts.ScheduleLease)
+	}
+}
+
+// withinWindow reports whether an action limited by window is still allowed for something sent at sent
+func withinWindow(sent time.Time, window time.Duration) bool {
+	return window <= 0 || time.Since(sent) <= window
+}
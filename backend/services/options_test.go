@@ -0,0 +1,56 @@
+package services
+
+import (
+	"testing"
+	"time"
+)
+
+func TestWithinWindow(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name   string
+		sent   time.Time
+		window time.Duration
+		want   bool
+	}{
+		{name: "no limit", sent: now.Add(-24 * time.Hour), window: 0, want: true},
+		{name: "inside", sent: now.Add(-time.Minute), window: 15 * time.Minute, want: true},
+		{name: "past", sent: now.Add(-time.Hour), window: 15 * time.Minute, want: false},
+	}
+	for _, tt := range tests {
+		if got := withinWindow(tt.sent, tt.window); got != tt.want {
+			t.Errorf("%s: withinWindow = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestLoadOptionsValidation(t *testing.T) {
+	tests := []struct {
+		name         string
+		interval     string
+		lease        string
+		wantInterval time.Duration
+		wantLease    time.Duration
+	}{
+		{name: "valid", interval: "1s", lease: "30s", wantInterval: time.Second, wantLease: 30 * time.Second},
+		{name: "zero", interval: "0s", lease: "0s", wantInterval: 5 * time.Second, wantLease: time.Minute},
+		{name: "negative", interval: "-1s", lease: "-1m", wantInterval: 5 * time.Second, wantLease: time.Minute},
+		{name: "unparsable", interval: "often", lease: "60", wantInterval: 5 * time.Second, wantLease: time.Minute},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			saved := Opts
+			defer func() { Opts = saved }()
+			t.Setenv("SCHEDULE_INTERVAL", tt.interval)
+			t.Setenv("SCHEDULE_LEASE", tt.lease)
+
+			LoadOptions()
+			if Opts.ScheduleInterval != tt.wantInterval {
+				t.Errorf("ScheduleInterval = %s, want %s", Opts.ScheduleInterval, tt.wantInterval)
+			}
+			if Opts.ScheduleLease != tt.wantLease {
+				t.Errorf("ScheduleLease = %s, want %s", Opts.ScheduleLease, tt.wantLease)
+			}
+		})
+	}
+}
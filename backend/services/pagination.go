@@ -0,0 +1,265 @@
+package services
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"line/config"
+	"line/models"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Page sizes of a room's message history
+const (
+	DefaultPageSize = 50
+	MaxPageSize     = 200
+)
+
+// PageQuery selects a page of a room's messages
+// At most one of Before, After and Around is used, in that order of precedence: Around, After, Before
+// Before and After take a cursor from an earlier page or a message ID; Around takes a message ID and
+// centers the page on it. With none of them the page holds the latest messages
+type PageQuery struct {
+	Before string
+	After  string
+	Around string
+	Limit  int
+}
+
+// Page is a slice of a room's messages, oldest first
+// PrevCursor loads older messages when passed as before and is empty when there are none;
+// NextCursor loads newer ones when passed as after. HasMore tells whether paging further in the
+// requested direction (both directions for around) returns anything
+type Page struct {
+	Messages   []models.Message `json:"messages"`
+	HasMore    bool             `json:"hasMore"`
+	PrevCursor string           `json:"prevCursor,omitempty"`
+	NextCursor string           `json:"nextCursor,omitempty"`
+}
+
+// position is a message's place in the sort order of a room: timestamp, then ID to break ties
+type position struct {
+	At int64              `json:"t"`
+	ID primitive.ObjectID `json:"id"`
+}
+
+func positionOf(msg models.Message) position {
+	return position{At: msg.Timestamp.UnixMilli(), ID: msg.ID}
+}
+
+// encodeCursor turns a position into an opaque token
+func encodeCursor(p position) string {
+	data, _ := json.Marshal(p)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// decodeCursor reads a cursor token, or a plain message ID of the room
+func decodeCursor(ctx context.Context, roomID primitive.ObjectID, cursor string) (position, error) {
+	if id, err := primitive.ObjectIDFromHex(cursor); err == nil {
+		return messagePosition(ctx, roomID, id)
+	}
+	return parseCursor(cursor)
+}
+
+// parseCursor reads a cursor token made by encodeCursor
+func parseCursor(cursor string) (position, error) {
+	var p position
+	data, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil || json.Unmarshal(data, &p) != nil || p.ID.IsZero() {
+		return p, badRequest("Invalid cursor")
+	}
+	return p, nil
+}
+
+// messagePosition returns the position of a message, which must belong to the room
+func messagePosition(ctx context.Context, roomID, id primitive.ObjectID) (position, error) {
+	msg, err := findMessage(ctx, id)
+	if err != nil {
+		return position{}, err
+	}
+	if msg.RoomID != roomID {
+		return position{}, notFound("Message not found")
+	}
+	return positionOf(msg), nil
+}
+
+// olderThan matches messages sorted before p, and p's own message too when inclusive
+func olderThan(p position, inclusive bool) bson.M {
+	idOp := "$lt"
+	if inclusive {
+		idOp = "$lte"
+	}
+	at := time.UnixMilli(p.At)
+	return bson.M{"$or": bson.A{
+		bson.M{"timestamp": bson.M{"$lt": at}},
+		bson.M{"timestamp": at, "_id": bson.M{idOp: p.ID}},
+	}}
+}
+
+// newerThan matches messages sorted after p, and p's own message too when inclusive
+func newerThan(p position, inclusive bool) bson.M {
+	idOp := "$gt"
+	if inclusive {
+		idOp = "$gte"
+	}
+	at := time.UnixMilli(p.At)
+	return bson.M{"$or": bson.A{
+		bson.M{"timestamp": bson.M{"$gt": at}},
+		bson.M{"timestamp": at, "_id": bson.M{idOp: p.ID}},
+	}}
+}
+
+// fetchMessages loads up to n messages matching base and bound in the given sort direction,
+// with their reply context, and reports whether more matched
+func fetchMessages(ctx context.Context, base, bound bson.M, dir, n int) ([]models.Message, bool, error) {
+	match := bson.M{}
+	for k, v := range base {
+		match[k] = v
+	}
+	if bound != nil {
+		match["$and"] = bson.A{bound}
+	}
+	pipeline := append([]bson.M{
+		{"$match": match},
+		{"$sort": bson.D{{Key: "timestamp", Value: dir}, {Key: "_id", Value: dir}}},
+		{"$limit": n + 1},
+	}, ReplyLookup()...)
+	cursor, err := config.DB.Collection("messages").Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, false, internal("DB aggregation error")
+	}
+	var messages []models.Message
+	if err := cursor.All(ctx, &messages); err != nil {
+		return nil, false, internal("DB cursor error")
+	}
+	if len(messages) > n {
+		return messages[:n], true, nil
+	}
+	return messages, false, nil
+}
+
+// anyMessage reports whether a message matches base and bound
+func anyMessage(ctx context.Context, base, bound bson.M) (bool, error) {
+	filter := bson.M{"$and": bson.A{base, bound}}
+	n, err := config.DB.Collection("messages").CountDocuments(ctx, filter, options.Count().SetLimit(1))
+	if err != nil {
+		return false, internal("DB error")
+	}
+	return n > 0, nil
+}
+
+// Page returns a page of a room's history to a member, leaving out messages they deleted for themselves
+// Thread replies are left out too; they are paged with Thread
+func (MessageService) Page(ctx context.Context, userID, roomID string, q PageQuery) (Page, error) {
+	rid, err := parseID(roomID, "room")
+	if err != nil {
+		return Page{}, err
+	}
+	uid, err := parseID(userID, "user")
+	if err != nil {
+		return Page{}, err
+	}
+	if err := requireMember(rid, userID); err != nil {
+		return Page{}, err
+	}
+	return loadPage(ctx, rid, bson.M{"roomId": rid, "threadId": nil, "hiddenFor": bson.M{"$ne": uid}}, q)
+}
+
+// aroundSplit divides an around page between the messages before the anchor and the anchor onwards
+// The anchor opens the newer half, which gets the odd message, so it is always in the page
+func aroundSplit(limit int) (older, newer int) {
+	return limit / 2, limit - limit/2
+}
+
+// loadPage returns the page q selects among the messages of a room matching base
+func loadPage(ctx context.Context, rid primitive.ObjectID, base bson.M, q PageQuery) (Page, error) {
+	limit := q.Limit
+	if limit <= 0 {
+		limit = DefaultPageSize
+	}
+	if limit > MaxPageSize {
+		limit = MaxPageSize
+	}
+
+	// older is newest first, newer is oldest first
+	var older, newer []models.Message
+	var hasOlder, hasNewer bool
+	switch {
+	case q.Around != "":
+		id, err := parseID(q.Around, "message")
+		if err != nil {
+			return Page{}, err
+		}
+		anchor, err := messagePosition(ctx, rid, id)
+		if err != nil {
+			return Page{}, err
+		}
+		olderLimit, newerLimit := aroundSplit(limit)
+		if older, hasOlder, err = fetchMessages(ctx, base, olderThan(anchor, false), -1, olderLimit); err != nil {
+			return Page{}, err
+		}
+		if newer, hasNewer, err = fetchMessages(ctx, base, newerThan(anchor, true), 1, newerLimit); err != nil {
+			return Page{}, err
+		}
+	case q.After != "":
+		p, err := decodeCursor(ctx, rid, q.After)
+		if err != nil {
+			return Page{}, err
+		}
+		if newer, hasNewer, err = fetchMessages(ctx, base, newerThan(p, false), 1, limit); err != nil {
+			return Page{}, err
+		}
+		if len(newer) > 0 {
+			if hasOlder, err = anyMessage(ctx, base, olderThan(positionOf(newer[0]), false)); err != nil {
+				return Page{}, err
+			}
+		}
+	case q.Before != "":
+		p, err := decodeCursor(ctx, rid, q.Before)
+		if err != nil {
+			return Page{}, err
+		}
+		if older, hasOlder, err = fetchMessages(ctx, base, olderThan(p, false), -1, limit); err != nil {
+			return Page{}, err
+		}
+		if len(older) > 0 {
+			if hasNewer, err = anyMessage(ctx, base, newerThan(positionOf(older[0]), false)); err != nil {
+				return Page{}, err
+			}
+		}
+	default:
+		var err error
+		if older, hasOlder, err = fetchMessages(ctx, base, nil, -1, limit); err != nil {
+			return Page{}, err
+		}
+	}
+
+	messages := make([]models.Message, 0, len(older)+len(newer))
+	for i := len(older) - 1; i >= 0; i-- {
+		messages = append(messages, older[i])
+	}
+	messages = append(messages, newer...)
+
+	page := Page{Messages: messages}
+	switch {
+	case q.Around != "":
+		page.HasMore = hasOlder || hasNewer
+	case q.After != "":
+		page.HasMore = hasNewer
+	default:
+		page.HasMore = hasOlder
+	}
+	if len(messages) > 0 {
+		if hasOlder {
+			page.PrevCursor = encodeCursor(positionOf(messages[0]))
+		}
+		if hasNewer {
+			page.NextCursor = encodeCursor(positionOf(messages[len(messages)-1]))
+		}
+	}
+	return page, nil
+}
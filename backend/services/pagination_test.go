@@ -0,0 +1,71 @@
+package services
+
+import (
+	"encoding/base64"
+	"errors"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestParseCursor(t *testing.T) {
+	id := primitive.NewObjectID()
+	valid := position{At: 1700000000123, ID: id}
+	tests := []struct {
+		name    string
+		cursor  string
+		want    position
+		wantErr bool
+	}{
+		{name: "round trip", cursor: encodeCursor(valid), want: valid},
+		{name: "zero time", cursor: encodeCursor(position{ID: id}), want: position{ID: id}},
+		{name: "empty", cursor: "", wantErr: true},
+		{name: "not base64", cursor: "%%%", wantErr: true},
+		{name: "not JSON", cursor: base64.RawURLEncoding.EncodeToString([]byte("nope")), wantErr: true},
+		{name: "missing ID", cursor: base64.RawURLEncoding.EncodeToString([]byte(`{"t":1}`)), wantErr: true},
+		{name: "bad ID", cursor: base64.RawURLEncoding.EncodeToString([]byte(`{"t":1,"id":"xyz"}`)), wantErr: true},
+		{name: "plain message ID", cursor: id.Hex(), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseCursor(tt.cursor)
+			if tt.wantErr {
+				var serr *Error
+				if !errors.As(err, &serr) || serr.Code() != "bad_request" {
+					t.Fatalf("parseCursor(%q) error = %v, want bad_request", tt.cursor, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseCursor(%q) failed: %v", tt.cursor, err)
+			}
+			if got != tt.want {
+				t.Errorf("parseCursor(%q) = %+v, want %+v", tt.cursor, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAroundSplit(t *testing.T) {
+	tests := []struct {
+		limit, older, newer int
+	}{
+		{limit: 1, older: 0, newer: 1},
+		{limit: 2, older: 1, newer: 1},
+		{limit: 5, older: 2, newer: 3},
+		{limit: DefaultPageSize, older: DefaultPageSize / 2, newer: DefaultPageSize / 2},
+		{limit: MaxPageSize - 1, older: MaxPageSize/2 - 1, newer: MaxPageSize / 2},
+	}
+	for _, tt := range tests {
+		older, newer := aroundSplit(tt.limit)
+		if older != tt.older || newer != tt.newer {
+			t.Errorf("aroundSplit(%d) = %d, %d, want %d, %d", tt.limit, older, newer, tt.older, tt.newer)
+		}
+		if older+newer != tt.limit {
+			t.Errorf("aroundSplit(%d) covers %d messages", tt.limit, older+newer)
+		}
+		if newer < 1 {
+			t.Errorf("aroundSplit(%d) leaves no room for the anchor", tt.limit)
+		}
+	}
+}
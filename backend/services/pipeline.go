@@ -0,0 +1,36 @@
+package services
+
+import "go.mongodb.org/mongo-driver/bson"
+
+// DeletedPlaceholder is shown in place of the content of a reply's deleted original
+const DeletedPlaceholder = "This message was deleted"
+
+// ReplyLookup returns the aggregation stages that fill repliedMessage on each message with the
+// sender, content and media of the message it replies to
+// A deleted original keeps its sender but shows DeletedPlaceholder and no media
+func ReplyLookup() []bson.M {
+	replied := func(field string) bson.M {
+		return bson.M{"$arrayElemAt": bson.A{"$repliedMessageDocs." + field, 0}}
+	}
+	deleted := bson.M{"$eq": bson.A{replied("deleted"), true}}
+	return []bson.M{
+		{"$lookup": bson.M{"from": "messages", "localField": "replyTo", "foreignField": "_id", "as": "repliedMessageDocs"}},
+		{"$lookup": bson.M{"from": "users", "localField": "repliedMessageDocs.senderId", "foreignField": "_id", "as": "repliedMessageSenders"}},
+		{"$addFields": bson.M{
+			"repliedMessage": bson.M{
+				"$cond": bson.M{
+					"if": bson.M{"$gt": bson.A{bson.M{"$size": "$repliedMessageDocs"}, 0}},
+					"then": bson.M{
+						"senderId":   bson.M{"$toString": replied("senderId")},
+						"senderName": bson.M{"$arrayElemAt": bson.A{"$repliedMessageSenders.username", 0}},
+						"content":    bson.M{"$cond": bson.A{deleted, DeletedPlaceholder, replied("content")}},
+						"mediaUrl":   bson.M{"$cond": bson.A{deleted, "$$REMOVE", replied("mediaUrl")}},
+						"deleted":    deleted,
+					},
+					"else": nil,
+				},
+			},
+		}},
+		{"$project": bson.M{"repliedMessageDocs": 0, "repliedMessageSenders": 0}},
+	}
+}
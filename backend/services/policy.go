@@ -0,0 +1,145 @@
+package services
+
+import (
+	"context"
+	"line/config"
+	"line/models"
+	"line/sockets"
+	"log"
+	"slices"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Action is a message action checked against the authorization policy
+type Action string
+
+const (
+	ActionView    Action = "view"
+	ActionReact   Action = "react"
+	ActionPin     Action = "pin"
+	ActionStar    Action = "star"
+	ActionEdit    Action = "edit"
+	ActionDelete  Action = "delete"
+	ActionHide    Action = "hide"
+	ActionForward Action = "forward"
+	ActionFollow  Action = "follow"
+)
+
+// Role is what a user is to a message; a policy entry may allow several roles
+type Role int
+
+const (
+	RoleMember Role = 1 << iota
+	RoleSender
+	RoleAdmin
+	// RoleDirect is any member of a one-to-one room, where neither side is an admin
+	RoleDirect
+)
+
+// Policy lists the roles allowed to perform each message action
+// Every role implies room membership, which is checked first. Unpin, unstar and unfollow share pin, star and follow
+var Policy = map[Action]Role{
+	ActionView:    RoleMember,
+	ActionReact:   RoleMember,
+	ActionPin:     RoleSender | RoleAdmin | RoleDirect,
+	ActionStar:    RoleMember,
+	ActionEdit:    RoleSender,
+	ActionDelete:  RoleSender | RoleAdmin,
+	ActionHide:    RoleMember,
+	ActionForward: RoleMember,
+	ActionFollow:  RoleMember,
+}
+
+// authorize fails with a 403 naming the missing role unless the user may perform the action on msg
+// Forwarding also needs membership of the target room, which the caller checks with requireMember
+func authorize(ctx context.Context, action Action, userID string, msg models.Message) error {
+	if err := requireMember(msg.RoomID, userID); err != nil {
+		return err
+	}
+	allowed := Policy[action]
+	if allowed&RoleMember != 0 {
+		return nil
+	}
+	if allowed&RoleSender != 0 && msg.SenderID.Hex() == userID {
+		return nil
+	}
+	if allowed&(RoleAdmin|RoleDirect) != 0 {
+		uid, err := parseID(userID, "user")
+		if err != nil {
+			return err
+		}
+		room, err := findRoomRoles(ctx, msg.RoomID)
+		if err != nil {
+			return err
+		}
+		if allowed&RoleDirect != 0 && !room.IsGroup {
+			return nil
+		}
+		if allowed&RoleAdmin != 0 && slices.Contains(room.Admins, uid) {
+			return nil
+		}
+	}
+	if allowed&RoleAdmin != 0 {
+		return notSenderOrAdmin("Only the sender or a room admin can " + string(action) + " this message")
+	}
+	return notSender("Only the sender can " + string(action) + " this message")
+}
+
+// requireMember fails unless the user belongs to the room
+func requireMember(roomID primitive.ObjectID, userID string) error {
+	ok, err := sockets.IsMember(roomID.Hex(), userID)
+	if err != nil {
+		return internal("Could not verify room membership")
+	}
+	if !ok {
+		return notMember("Not a member of this room")
+	}
+	return nil
+}
+
+// findRoomRoles loads what the admin and direct roles depend on: whether the room is a group and its admins
+func findRoomRoles(ctx context.Context, roomID primitive.ObjectID) (models.Room, error) {
+	var room models.Room
+	opts := options.FindOne().SetProjection(bson.M{"isGroup": 1, "admins": 1})
+	err := config.DB.Collection("rooms").FindOne(ctx, bson.M{"_id": roomID}, opts).Decode(&room)
+	if err == mongo.ErrNoDocuments {
+		return room, notFound("Room not found")
+	}
+	if err != nil {
+		return room, internal("DB error")
+	}
+	return room, nil
+}
+
+// EnsureRoomAdmins gives group rooms created before rooms had admins a set of admins
+// Those rooms never recorded their creator, so every current member becomes an admin; without this the
+// admin-only actions could never be performed in them
+func EnsureRoomAdmins() {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	res, err := config.DB.Collection("rooms").UpdateMany(ctx,
+		bson.M{"isGroup": true, "admins.0": bson.M{"$exists": false}},
+		mongo.Pipeline{{{Key: "$set", Value: bson.M{"admins": "$members"}}}},
+	)
+	if err != nil {
+		log.Println("Could not backfill room admins:", err)
+		return
+	}
+	if res.ModifiedCount > 0 {
+		log.Printf("Backfilled admins of %d rooms", res.ModifiedCount)
+	}
+}
+
+// AuthorizeRoom fails unless the user is a member of the room, for room-level reads such as listing messages
+func (MessageService) AuthorizeRoom(userID, roomID string) error {
+	rid, err := parseID(roomID, "room")
+	if err != nil {
+		return err
+	}
+	return requireMember(rid, userID)
+}
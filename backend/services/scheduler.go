@@ -0,0 +1,408 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"line/config"
+	"line/models"
+	"line/sockets"
+	"log"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Limits of scheduled messages
+const (
+	MaxScheduleAhead     = 365 * 24 * time.Hour
+	maxScheduleAttempts  = 5
+	scheduleRetryBackoff = 30 * time.Second
+)
+
+// ScheduleRequest is a message to send to a room at SendAt
+type ScheduleRequest struct {
+	RoomID   string    `json:"roomId"`
+	Content  string    `json:"content"`
+	MediaURL string    `json:"mediaUrl,omitempty"`
+	ReplyTo  string    `json:"replyTo,omitempty"`
+	ThreadID string    `json:"threadId,omitempty"`
+	SendAt   time.Time `json:"sendAt"`
+}
+
+// ScheduleUpdate changes a scheduled message; nil fields are left as they are
+type ScheduleUpdate struct {
+	Content  *string    `json:"content"`
+	MediaURL *string    `json:"mediaUrl"`
+	SendAt   *time.Time `json:"sendAt"`
+}
+
+func scheduledCollection() *mongo.Collection {
+	return config.DB.Collection("scheduled_messages")
+}
+
+// checkSendAt fails unless t is in the future and within MaxScheduleAhead
+func checkSendAt(t time.Time) error {
+	now := time.Now()
+	if !t.After(now) {
+		return badRequest("sendAt must be in the future")
+	}
+	if t.Sub(now) > MaxScheduleAhead {
+		return badRequest("sendAt is too far ahead")
+	}
+	return nil
+}
+
+// unclaimed matches scheduled messages no scheduler run is sending right now
+// A claim whose lease ran out belongs to a run that died, so it no longer counts
+func unclaimed(now time.Time) bson.M {
+	return bson.M{"$or": bson.A{
+		bson.M{"claim": nil},
+		bson.M{"claimedUntil": bson.M{"$lte": now}},
+	}}
+}
+
+// Schedule stores a message to be sent to a room at req.SendAt
+// The same rules as Send apply when it is stored and again when it is sent
+func (MessageService) Schedule(ctx context.Context, userID string, req ScheduleRequest) (models.ScheduledMessage, error) {
+	rid, err := parseID(req.RoomID, "room")
+	if err != nil {
+		return models.ScheduledMessage{}, err
+	}
+	sid, err := parseID(userID, "user")
+	if err != nil {
+		return models.ScheduledMessage{}, err
+	}
+	if req.Content == "" && req.MediaURL == "" {
+		return models.ScheduledMessage{}, badRequest("Message has no content")
+	}
+	if err := checkSendAt(req.SendAt); err != nil {
+		return models.ScheduledMessage{}, err
+	}
+	if err := requireMember(rid, userID); err != nil {
+		return models.ScheduledMessage{}, err
+	}
+	now := time.Now()
+	scheduled := models.ScheduledMessage{
+		RoomID:    rid,
+		SenderID:  sid,
+		Content:   req.Content,
+		MediaURL:  req.MediaURL,
+		SendAt:    req.SendAt,
+		Status:    models.ScheduledPending,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	if req.ReplyTo != "" {
+		replyTo, err := replyTarget(ctx, rid, req.ReplyTo)
+		if err != nil {
+			return models.ScheduledMessage{}, err
+		}
+		scheduled.ReplyTo = &replyTo
+	}
+	if req.ThreadID != "" {
+		root, err := threadRoot(ctx, rid, req.ThreadID)
+		if err != nil {
+			return models.ScheduledMessage{}, err
+		}
+		scheduled.ThreadID = &root.ID
+	}
+	res, err := scheduledCollection().InsertOne(ctx, scheduled)
+	if err != nil {
+		return models.ScheduledMessage{}, internal("Could not save scheduled message")
+	}
+	scheduled.ID = res.InsertedID.(primitive.ObjectID)
+	return scheduled, nil
+}
+
+// Scheduled lists the user's pending and failed scheduled messages, next due first
+// An empty roomID lists every room
+func (MessageService) Scheduled(ctx context.Context, userID, roomID string) ([]models.ScheduledMessage, error) {
+	uid, err := parseID(userID, "user")
+	if err != nil {
+		return nil, err
+	}
+	filter := bson.M{
+		"senderId": uid,
+		"status":   bson.M{"$in": bson.A{models.ScheduledPending, models.ScheduledFailed}},
+	}
+	if roomID != "" {
+		rid, err := parseID(roomID, "room")
+		if err != nil {
+			return nil, err
+		}
+		filter["roomId"] = rid
+	}
+	cursor, err := scheduledCollection().Find(ctx, filter, options.Find().SetSort(bson.D{{Key: "sendAt", Value: 1}, {Key: "_id", Value: 1}}))
+	if err != nil {
+		return nil, internal("DB error")
+	}
+	scheduled := []models.ScheduledMessage{}
+	if err := cursor.All(ctx, &scheduled); err != nil {
+		return nil, internal("DB error")
+	}
+	return scheduled, nil
+}
+
+// findScheduled loads one of the user's scheduled messages
+func findScheduled(ctx context.Context, id, userID primitive.ObjectID) (models.ScheduledMessage, error) {
+	var scheduled models.ScheduledMessage
+	err := scheduledCollection().FindOne(ctx, bson.M{"_id": id, "senderId": userID}).Decode(&scheduled)
+	if err != nil {
+		return scheduled, notFound("Scheduled message not found")
+	}
+	return scheduled, nil
+}
+
+// notChangeable explains why a scheduled message matched no update: it is gone, sent or being sent
+func notChangeable(ctx context.Context, id, userID primitive.ObjectID) error {
+	scheduled, err := findScheduled(ctx, id, userID)
+	if err != nil {
+		return err
+	}
+	if scheduled.Status == models.ScheduledSent {
+		return conflict("The message was already sent")
+	}
+	return conflict("The message is being sent")
+}
+
+// UpdateScheduled changes the content or send time of one of the user's scheduled messages
+// A failed scheduled message goes back to pending, so editing it is also how it is retried
+func (MessageService) UpdateScheduled(ctx context.Context, userID, scheduledID string, change ScheduleUpdate) (models.ScheduledMessage, error) {
+	id, err := parseID(scheduledID, "scheduled message")
+	if err != nil {
+		return models.ScheduledMessage{}, err
+	}
+	uid, err := parseID(userID, "user")
+	if err != nil {
+		return models.ScheduledMessage{}, err
+	}
+	current, err := findScheduled(ctx, id, uid)
+	if err != nil {
+		return models.ScheduledMessage{}, err
+	}
+	now := time.Now()
+	set := bson.M{"status": models.ScheduledPending, "attempts": 0, "updatedAt": now}
+	if change.Content != nil {
+		current.Content = *change.Content
+		set["content"] = current.Content
+	}
+	if change.MediaURL != nil {
+		current.MediaURL = *change.MediaURL
+		set["mediaUrl"] = current.MediaURL
+	}
+	if change.SendAt != nil {
+		if err := checkSendAt(*change.SendAt); err != nil {
+			return models.ScheduledMessage{}, err
+		}
+		set["sendAt"] = *change.SendAt
+	} else if current.Status == models.ScheduledFailed && current.SendAt.Before(now) {
+		// Retrying a failed message without a new time sends it right away
+		set["sendAt"] = now
+	}
+	if current.Content == "" && current.MediaURL == "" {
+		return models.ScheduledMessage{}, badRequest("Message has no content")
+	}
+
+	filter := bson.M{
+		"_id":      id,
+		"senderId": uid,
+		"status":   bson.M{"$in": bson.A{models.ScheduledPending, models.ScheduledFailed}},
+		"$and":     bson.A{unclaimed(now)},
+	}
+	var updated models.ScheduledMessage
+	err = scheduledCollection().FindOneAndUpdate(ctx, filter,
+		bson.M{"$set": set, "$unset": bson.M{"error": "", "claim": "", "claimedUntil": ""}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&updated)
+	if err == mongo.ErrNoDocuments {
+		return models.ScheduledMessage{}, notChangeable(ctx, id, uid)
+	}
+	if err != nil {
+		return models.ScheduledMessage{}, internal("DB error")
+	}
+	return updated, nil
+}
+
+// CancelScheduled deletes one of the user's scheduled messages before it is sent
+func (MessageService) CancelScheduled(ctx context.Context, userID, scheduledID string) error {
+	id, err := parseID(scheduledID, "scheduled message")
+	if err != nil {
+		return err
+	}
+	uid, err := parseID(userID, "user")
+	if err != nil {
+		return err
+	}
+	filter := bson.M{
+		"_id":      id,
+		"senderId": uid,
+		"status":   bson.M{"$in": bson.A{models.ScheduledPending, models.ScheduledFailed}},
+		"$and":     bson.A{unclaimed(time.Now())},
+	}
+	res, err := scheduledCollection().DeleteOne(ctx, filter)
+	if err != nil {
+		return internal("DB error")
+	}
+	if res.DeletedCount == 0 {
+		return notChangeable(ctx, id, uid)
+	}
+	return nil
+}
+
+// ScheduleRunner sends scheduled messages when they are due
+// Every instance runs one. A message is claimed with a lease before it is sent, so only one instance
+// sends it; if that instance dies the lease runs out and another picks the message up. Messages
+// record the scheduled message they came from, so a retry after a send that did go through only
+// marks it sent
+type ScheduleRunner struct {
+	stop chan struct{}
+	done chan struct{}
+}
+
+// Scheduler is the runner started by main
+var Scheduler = &ScheduleRunner{stop: make(chan struct{}), done: make(chan struct{})}
+
+// Run sends due messages every Opts.ScheduleInterval until Shutdown
+func (s *ScheduleRunner) Run() {
+	defer close(s.done)
+	ticker := time.NewTicker(Opts.ScheduleInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+			s.sendDue()
+		}
+	}
+}
+
+// Shutdown stops the runner and waits for a send in progress to finish
+// It must be called before the hub shuts down, since sending feeds the hub
+func (s *ScheduleRunner) Shutdown(ctx context.Context) error {
+	close(s.stop)
+	select {
+	case <-s.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// sendDue claims and sends due messages one at a time until none is left or the runner is stopped
+func (s *ScheduleRunner) sendDue() {
+	for {
+		select {
+		case <-s.stop:
+			return
+		default:
+		}
+		if sockets.Closing() {
+			return
+		}
+		scheduled, ok := claimDue()
+		if !ok {
+			return
+		}
+		sendScheduled(scheduled)
+	}
+}
+
+// claimDue takes the lease on the next due message, if there is one
+func claimDue() (models.ScheduledMessage, bool) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	now := time.Now()
+	// Past claimedUntil the lease of a run that died has run out, or the delay before a retry is over
+	filter := bson.M{
+		"status": models.ScheduledPending,
+		"sendAt": bson.M{"$lte": now},
+		"$or": bson.A{
+			bson.M{"claimedUntil": nil},
+			bson.M{"claimedUntil": bson.M{"$lte": now}},
+		},
+	}
+	update := bson.M{
+		"$set": bson.M{"claim": primitive.NewObjectID().Hex(), "claimedUntil": now.Add(Opts.ScheduleLease)},
+		"$inc": bson.M{"attempts": 1},
+	}
+	opts := options.FindOneAndUpdate().
+		SetSort(bson.D{{Key: "sendAt", Value: 1}}).
+		SetReturnDocument(options.After)
+	var scheduled models.ScheduledMessage
+	err := scheduledCollection().FindOneAndUpdate(ctx, filter, update, opts).Decode(&scheduled)
+	if err != nil {
+		if err != mongo.ErrNoDocuments {
+			log.Println("Scheduler claim error:", err)
+		}
+		return scheduled, false
+	}
+	return scheduled, true
+}
+
+// sendScheduled sends a claimed message through Send and records the outcome
+// Errors the sender can act on, such as having left the room, fail it at once; others are retried
+// with a growing delay up to maxScheduleAttempts
+func sendScheduled(scheduled models.ScheduledMessage) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	owned := bson.M{"_id": scheduled.ID, "claim": scheduled.Claim}
+
+	// A message from an earlier attempt means that send went through before its outcome was recorded
+	var sent models.Message
+	err := config.DB.Collection("messages").FindOne(ctx, bson.M{"scheduledId": scheduled.ID}).Decode(&sent)
+	if err == nil {
+		markSent(ctx, owned, sent.ID)
+		return
+	}
+	if err != mongo.ErrNoDocuments {
+		log.Println("Scheduler lookup error:", err)
+		return
+	}
+
+	req := sockets.MessageRequest{
+		RoomID:      scheduled.RoomID.Hex(),
+		Content:     scheduled.Content,
+		MediaURL:    scheduled.MediaURL,
+		ScheduledID: scheduled.ID.Hex(),
+	}
+	if scheduled.ReplyTo != nil {
+		req.ReplyTo = scheduled.ReplyTo.Hex()
+	}
+	if scheduled.ThreadID != nil {
+		req.ThreadID = scheduled.ThreadID.Hex()
+	}
+	event, err := Messages.Send(ctx, scheduled.SenderID.Hex(), req)
+	if err == nil {
+		id, _ := primitive.ObjectIDFromHex(event.ID)
+		markSent(ctx, owned, id)
+		return
+	}
+
+	var svcErr *Error
+	permanent := errors.As(err, &svcErr) && svcErr.Status() < 500
+	set := bson.M{"error": err.Error(), "updatedAt": time.Now()}
+	if permanent || scheduled.Attempts >= maxScheduleAttempts {
+		set["status"] = models.ScheduledFailed
+	} else {
+		set["claimedUntil"] = time.Now().Add(time.Duration(scheduled.Attempts) * scheduleRetryBackoff)
+	}
+	if _, err := scheduledCollection().UpdateOne(ctx, owned, bson.M{"$set": set, "$unset": bson.M{"claim": ""}}); err != nil {
+		log.Println("Scheduler update error:", err)
+	}
+	log.Printf("Scheduled message %s not sent (attempt %d): %v", scheduled.ID.Hex(), scheduled.Attempts, err)
+}
+
+// markSent records the message a scheduled message was sent as, if the claim is still ours
+func markSent(ctx context.Context, owned bson.M, messageID primitive.ObjectID) {
+	_, err := scheduledCollection().UpdateOne(ctx, owned, bson.M{
+		"$set":   bson.M{"status": models.ScheduledSent, "messageId": messageID, "updatedAt": time.Now()},
+		"$unset": bson.M{"claim": "", "claimedUntil": "", "error": ""},
+	})
+	if err != nil {
+		log.Println("Scheduler update error:", err)
+	}
+}
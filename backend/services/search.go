@@ -0,0 +1,317 @@
+package services
+
+import (
+	"context"
+	"line/config"
+	"line/models"
+	"strings"
+	"time"
+	"unicode"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Search result sizes
+const (
+	DefaultSearchSize = 20
+	MaxSearchSize     = 50
+	snippetRadius     = 60
+)
+
+// SearchQuery is a full-text message search with optional filters
+// Text uses MongoDB text search syntax: words, "exact phrases" and -excluded words
+// From and To bound the message time; HasMedia keeps only messages with (true) or without (false) media
+type SearchQuery struct {
+	Text     string
+	RoomID   string
+	SenderID string
+	From     time.Time
+	To       time.Time
+	HasMedia *bool
+	Limit    int
+	Offset   int
+}
+
+// SnippetPart is a run of snippet text; Match marks the runs that matched the query
+type SnippetPart struct {
+	Text  string `json:"text"`
+	Match bool   `json:"match,omitempty"`
+}
+
+// SearchHit is one matching message
+// Context is the history page centered on the message, to open the conversation at that point;
+// for a thread reply it is the page of the thread
+type SearchHit struct {
+	MessageID  string        `json:"messageId"`
+	RoomID     string        `json:"roomId"`
+	RoomName   string        `json:"roomName"`
+	SenderID   string        `json:"senderId"`
+	SenderName string        `json:"senderName"`
+	Timestamp  time.Time     `json:"timestamp"`
+	MediaURL   string        `json:"mediaUrl,omitempty"`
+	Snippet    []SnippetPart `json:"snippet"`
+	Score      float64       `json:"score"`
+	Context    string        `json:"context"`
+}
+
+// SearchResults is a page of hits, best first; NextOffset continues the search when HasMore is set
+type SearchResults struct {
+	Results    []SearchHit `json:"results"`
+	HasMore    bool        `json:"hasMore"`
+	NextOffset int         `json:"nextOffset,omitempty"`
+}
+
+// Search finds messages matching the query in the rooms the user belongs to
+// Messages deleted for everyone or hidden by the user are never returned
+func (MessageService) Search(ctx context.Context, userID string, q SearchQuery) (SearchResults, error) {
+	uid, err := parseID(userID, "user")
+	if err != nil {
+		return SearchResults{}, err
+	}
+	q.Text = strings.TrimSpace(q.Text)
+	if q.Text == "" {
+		return SearchResults{}, badRequest("q is required")
+	}
+	limit := q.Limit
+	if limit <= 0 {
+		limit = DefaultSearchSize
+	}
+	if limit > MaxSearchSize {
+		limit = MaxSearchSize
+	}
+
+	rooms, err := userRooms(ctx, uid)
+	if err != nil {
+		return SearchResults{}, err
+	}
+	roomIDs := make([]primitive.ObjectID, 0, len(rooms))
+	for id := range rooms {
+		roomIDs = append(roomIDs, id)
+	}
+	filter := bson.M{
+		"$text":     bson.M{"$search": q.Text},
+		"roomId":    bson.M{"$in": roomIDs},
+		"hiddenFor": bson.M{"$ne": uid},
+		"deleted":   bson.M{"$ne": true},
+	}
+	if q.RoomID != "" {
+		rid, err := parseID(q.RoomID, "room")
+		if err != nil {
+			return SearchResults{}, err
+		}
+		if _, ok := rooms[rid]; !ok {
+			return SearchResults{}, notMember("Not a member of this room")
+		}
+		filter["roomId"] = rid
+	}
+	if q.SenderID != "" {
+		sid, err := parseID(q.SenderID, "sender")
+		if err != nil {
+			return SearchResults{}, err
+		}
+		filter["senderId"] = sid
+	}
+	if !q.From.IsZero() || !q.To.IsZero() {
+		span := bson.M{}
+		if !q.From.IsZero() {
+			span["$gte"] = q.From
+		}
+		if !q.To.IsZero() {
+			span["$lte"] = q.To
+		}
+		filter["timestamp"] = span
+	}
+	if q.HasMedia != nil {
+		if *q.HasMedia {
+			filter["mediaUrl"] = bson.M{"$nin": bson.A{nil, ""}}
+		} else {
+			filter["mediaUrl"] = bson.M{"$in": bson.A{nil, ""}}
+		}
+	}
+
+	score := bson.M{"$meta": "textScore"}
+	opts := options.Find().
+		SetProjection(bson.M{"score": score}).
+		SetSort(bson.D{{Key: "score", Value: score}, {Key: "timestamp", Value: -1}}).
+		SetSkip(int64(q.Offset)).
+		SetLimit(int64(limit + 1))
+	cursor, err := config.DB.Collection("messages").Find(ctx, filter, opts)
+	if err != nil {
+		return SearchResults{}, internal("Search failed")
+	}
+	var found []struct {
+		models.Message `bson:",inline"`
+		Score          float64 `bson:"score"`
+	}
+	if err := cursor.All(ctx, &found); err != nil {
+		return SearchResults{}, internal("Search failed")
+	}
+
+	results := SearchResults{Results: []SearchHit{}}
+	if len(found) > limit {
+		found = found[:limit]
+		results.HasMore = true
+		results.NextOffset = q.Offset + limit
+	}
+	senderIDs := []primitive.ObjectID{}
+	for _, f := range found {
+		senderIDs = append(senderIDs, f.SenderID)
+	}
+	names, err := usernames(ctx, senderIDs)
+	if err != nil {
+		return SearchResults{}, err
+	}
+	terms := searchTerms(q.Text)
+	for _, f := range found {
+		link := "/rooms/" + f.RoomID.Hex() + "/messages?around=" + f.ID.Hex()
+		if f.ThreadID != nil {
+			link = "/messages/" + f.ThreadID.Hex() + "/thread?around=" + f.ID.Hex()
+		}
+		results.Results = append(results.Results, SearchHit{
+			MessageID:  f.ID.Hex(),
+			RoomID:     f.RoomID.Hex(),
+			RoomName:   rooms[f.RoomID],
+			SenderID:   f.SenderID.Hex(),
+			SenderName: names[f.SenderID],
+			Timestamp:  f.Timestamp,
+			MediaURL:   f.MediaURL,
+			Snippet:    snippet(f.Content, terms),
+			Score:      f.Score,
+			Context:    link,
+		})
+	}
+	return results, nil
+}
+
+// userRooms returns the names of the rooms the user is a member of, by room ID
+func userRooms(ctx context.Context, uid primitive.ObjectID) (map[primitive.ObjectID]string, error) {
+	cursor, err := config.DB.Collection("rooms").Find(ctx, bson.M{"members": uid}, options.Find().SetProjection(bson.M{"name": 1}))
+	if err != nil {
+		return nil, internal("DB error")
+	}
+	var rooms []models.Room
+	if err := cursor.All(ctx, &rooms); err != nil {
+		return nil, internal("DB error")
+	}
+	names := make(map[primitive.ObjectID]string, len(rooms))
+	for _, room := range rooms {
+		names[room.ID] = room.Name
+	}
+	return names, nil
+}
+
+// usernames returns the usernames of the given users, by user ID
+func usernames(ctx context.Context, ids []primitive.ObjectID) (map[primitive.ObjectID]string, error) {
+	names := make(map[primitive.ObjectID]string, len(ids))
+	if len(ids) == 0 {
+		return names, nil
+	}
+	cursor, err := config.DB.Collection("users").Find(ctx, bson.M{"_id": bson.M{"$in": ids}}, options.Find().SetProjection(bson.M{"username": 1}))
+	if err != nil {
+		return nil, internal("DB error")
+	}
+	var users []models.User
+	if err := cursor.All(ctx, &users); err != nil {
+		return nil, internal("DB error")
+	}
+	for _, u := range users {
+		names[u.ID] = u.Username
+	}
+	return names, nil
+}
+
+// searchTerms returns the lower-cased words and phrases of a text query, leaving out excluded words
+func searchTerms(text string) []string {
+	var terms []string
+	for i, part := range strings.Split(text, `"`) {
+		if i%2 == 1 {
+			// Odd parts sit between quotes and are phrases
+			if phrase := strings.ToLower(strings.TrimSpace(part)); phrase != "" {
+				terms = append(terms, phrase)
+			}
+			continue
+		}
+		for _, word := range strings.Fields(part) {
+			if strings.HasPrefix(word, "-") {
+				continue
+			}
+			if word = strings.ToLower(strings.TrimFunc(word, isSeparator)); word != "" {
+				terms = append(terms, word)
+			}
+		}
+	}
+	return terms
+}
+
+func isSeparator(r rune) bool {
+	return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+}
+
+// snippet cuts the content around its first match and splits it into matching and plain runs
+// A term matches where a word starts with it, so stemmed hits such as "addresses" for "address" are marked too
+func snippet(content string, terms []string) []SnippetPart {
+	text := []rune(content)
+	lower := []rune(strings.ToLower(content))
+	if len(lower) != len(text) {
+		// Lower-casing changed the length, so offsets would not line up; fall back to the plain text
+		lower = text
+	}
+	type span struct{ start, end int }
+	var spans []span
+	for i := 0; i < len(lower); {
+		if i > 0 && !isSeparator(lower[i-1]) {
+			i++
+			continue
+		}
+		matched := 0
+		for _, term := range terms {
+			t := []rune(term)
+			if len(t) > matched && i+len(t) <= len(lower) && string(lower[i:i+len(t)]) == term {
+				matched = len(t)
+			}
+		}
+		if matched == 0 {
+			i++
+			continue
+		}
+		end := i + matched
+		for end < len(lower) && !isSeparator(lower[end]) {
+			end++
+		}
+		spans = append(spans, span{i, end})
+		i = end
+	}
+
+	from, to := 0, len(text)
+	if len(spans) > 0 {
+		from = max(0, spans[0].start-snippetRadius)
+		to = min(len(text), spans[0].end+snippetRadius)
+	} else if to > 2*snippetRadius {
+		to = 2 * snippetRadius
+	}
+	var parts []SnippetPart
+	add := func(s string, match bool) {
+		if s != "" {
+			parts = append(parts, SnippetPart{Text: s, Match: match})
+		}
+	}
+	if from > 0 {
+		add("…", false)
+	}
+	pos := from
+	for _, s := range spans {
+		if s.start < from || s.end > to {
+			continue
+		}
+		add(string(text[pos:s.start]), false)
+		add(string(text[s.start:s.end]), true)
+		pos = s.end
+	}
+	add(string(text[pos:to]), false)
+	if to < len(text) {
+		add("…", false)
+	}
+	return parts
+}
@@ -0,0 +1,117 @@
+package services
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSearchTerms(t *testing.T) {
+	tests := []struct {
+		text string
+		want []string
+	}{
+		{text: "hello", want: []string{"hello"}},
+		{text: "Hello World", want: []string{"hello", "world"}},
+		{text: `Address "new office" -old`, want: []string{"address", "new office"}},
+		{text: `"Exact Phrase"`, want: []string{"exact phrase"}},
+		{text: `lunch? (today)`, want: []string{"lunch", "today"}},
+		{text: `-only -excluded`, want: nil},
+		{text: `"" "  "`, want: nil},
+		{text: `unclosed "phrase here`, want: []string{"unclosed", "phrase here"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.text, func(t *testing.T) {
+			if got := searchTerms(tt.text); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("searchTerms(%q) = %q, want %q", tt.text, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSnippet(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		terms   []string
+		want    []SnippetPart
+	}{
+		{
+			name:    "single match",
+			content: "Send the report today",
+			terms:   []string{"report"},
+			want:    []SnippetPart{{Text: "Send the "}, {Text: "report", Match: true}, {Text: " today"}},
+		},
+		{
+			name:    "case-insensitive prefix match marks the whole word",
+			content: "Two Addresses changed",
+			terms:   []string{"address"},
+			want:    []SnippetPart{{Text: "Two "}, {Text: "Addresses", Match: true}, {Text: " changed"}},
+		},
+		{
+			name:    "only word starts match",
+			content: "readdress it",
+			terms:   []string{"address"},
+			want:    []SnippetPart{{Text: "readdress it"}},
+		},
+		{
+			name:    "phrase and word",
+			content: "the new office has a new desk",
+			terms:   []string{"new office", "desk"},
+			want: []SnippetPart{
+				{Text: "the "}, {Text: "new office", Match: true}, {Text: " has a new "}, {Text: "desk", Match: true},
+			},
+		},
+		{
+			name:    "longest term wins",
+			content: "new office",
+			terms:   []string{"new", "new office"},
+			want:    []SnippetPart{{Text: "new office", Match: true}},
+		},
+		{
+			name:    "no terms",
+			content: "plain text",
+			want:    []SnippetPart{{Text: "plain text"}},
+		},
+		{
+			name:    "empty content",
+			content: "",
+			terms:   []string{"x"},
+			want:    nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := snippet(tt.content, tt.terms); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("snippet(%q, %q) = %+v, want %+v", tt.content, tt.terms, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSnippetWindow(t *testing.T) {
+	before := strings.Repeat("a ", 100)
+	after := strings.Repeat(" b", 100)
+	got := snippet(before+"needle"+after, []string{"needle"})
+	if len(got) != 5 {
+		t.Fatalf("snippet has %d parts, want 5: %+v", len(got), got)
+	}
+	if got[0].Text != "…" || got[4].Text != "…" {
+		t.Errorf("snippet is not elided on both sides: %+v", got)
+	}
+	if got[2] != (SnippetPart{Text: "needle", Match: true}) {
+		t.Errorf("middle part = %+v, want the match", got[2])
+	}
+	if n := len([]rune(got[1].Text)); n != snippetRadius {
+		t.Errorf("context before the match is %d characters, want %d", n, snippetRadius)
+	}
+	if n := len([]rune(got[3].Text)); n != snippetRadius {
+		t.Errorf("context after the match is %d characters, want %d", n, snippetRadius)
+	}
+
+	long := strings.Repeat("x", 3*snippetRadius)
+	got = snippet(long, []string{"missing"})
+	if len(got) != 2 || len([]rune(got[0].Text)) != 2*snippetRadius || got[1].Text != "…" {
+		t.Errorf("snippet without a match = %+v, want the first %d characters and an ellipsis", got, 2*snippetRadius)
+	}
+}
@@ -0,0 +1,187 @@
+package services
+
+import (
+	"context"
+	"line/config"
+	"line/models"
+	"line/sockets"
+	"slices"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// ThreadPage is a page of a thread's replies, oldest first, with the root message it hangs off
+// Following tells whether the current user is notified of new replies
+type ThreadPage struct {
+	Root      models.Message `json:"root"`
+	Following bool           `json:"following"`
+	Page
+}
+
+// threadRoot resolves the root of the thread a reply goes to
+// Replying to a message that is itself a thread reply lands in the same thread, so threads stay one level deep
+func threadRoot(ctx context.Context, roomID primitive.ObjectID, threadID string) (models.Message, error) {
+	id, err := parseID(threadID, "thread")
+	if err != nil {
+		return models.Message{}, err
+	}
+	root, err := findLiveMessage(ctx, id)
+	if err != nil {
+		return root, err
+	}
+	if root.RoomID != roomID {
+		return root, badRequest("Thread belongs to another room")
+	}
+	if root.ThreadID != nil {
+		return threadRoot(ctx, roomID, root.ThreadID.Hex())
+	}
+	return root, nil
+}
+
+// addThreadReply counts a stored reply on its root and makes the replier a follower
+// The root's sender is only added by the reply that starts the thread, so unfollowing sticks for them
+// It returns the thread event to emit, addressed to the followers other than the replier
+func addThreadReply(ctx context.Context, root, reply models.Message) (sockets.ThreadEvent, error) {
+	var updated models.Message
+	err := config.DB.Collection("messages").FindOneAndUpdate(ctx,
+		bson.M{"_id": root.ID},
+		bson.M{
+			"$inc":      bson.M{"replyCount": 1},
+			"$max":      bson.M{"lastReplyAt": reply.Timestamp},
+			"$addToSet": bson.M{"threadFollowers": reply.SenderID},
+		},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&updated)
+	if err != nil {
+		return sockets.ThreadEvent{}, internal("Could not update thread")
+	}
+	// The count is incremented atomically, so exactly one reply sees the thread start
+	if updated.ReplyCount == 1 && root.SenderID != reply.SenderID {
+		_, err := config.DB.Collection("messages").UpdateByID(ctx, root.ID, bson.M{"$addToSet": bson.M{"threadFollowers": root.SenderID}})
+		if err != nil {
+			return sockets.ThreadEvent{}, internal("Could not update thread")
+		}
+		if !slices.Contains(updated.ThreadFollowers, root.SenderID) {
+			updated.ThreadFollowers = append(updated.ThreadFollowers, root.SenderID)
+		}
+	}
+	followers := []string{}
+	for _, id := range updated.ThreadFollowers {
+		if id != reply.SenderID {
+			followers = append(followers, id.Hex())
+		}
+	}
+	event := sockets.ThreadEvent{
+		Type:       "thread_reply",
+		RoomID:     root.RoomID.Hex(),
+		ThreadID:   root.ID.Hex(),
+		ReplyCount: updated.ReplyCount,
+		Followers:  followers,
+	}
+	if updated.LastReplyAt != nil {
+		event.LastReplyAt = *updated.LastReplyAt
+	}
+	return event, nil
+}
+
+// removeThreadReply takes a reply deleted for everyone out of its root's summary
+// The count drops by one and lastReplyAt moves back to the newest reply still standing, or is cleared
+func removeThreadReply(ctx context.Context, rootID primitive.ObjectID) error {
+	messages := config.DB.Collection("messages")
+	var latest models.Message
+	opts := options.FindOne().SetSort(bson.D{{Key: "timestamp", Value: -1}, {Key: "_id", Value: -1}}).SetProjection(bson.M{"timestamp": 1})
+	err := messages.FindOne(ctx, bson.M{"threadId": rootID, "deleted": bson.M{"$ne": true}}, opts).Decode(&latest)
+	update := bson.M{"$inc": bson.M{"replyCount": -1}}
+	switch {
+	case err == mongo.ErrNoDocuments:
+		update["$unset"] = bson.M{"lastReplyAt": ""}
+	case err != nil:
+		return internal("Could not update thread")
+	default:
+		update["$set"] = bson.M{"lastReplyAt": latest.Timestamp}
+	}
+	if _, err := messages.UpdateOne(ctx, bson.M{"_id": rootID, "replyCount": bson.M{"$gt": 0}}, update); err != nil {
+		return internal("Could not update thread")
+	}
+	return nil
+}
+
+// findRoot loads a message that can carry a thread, which a thread reply cannot
+func findRoot(ctx context.Context, messageID string) (models.Message, error) {
+	id, err := parseID(messageID, "message")
+	if err != nil {
+		return models.Message{}, err
+	}
+	root, err := findMessage(ctx, id)
+	if err != nil {
+		return root, err
+	}
+	if root.ThreadID != nil {
+		return root, badRequest("Message is a thread reply")
+	}
+	return root, nil
+}
+
+// Thread returns a page of the replies to a message to a member of its room
+// The query works as for Page, with cursors and around IDs taken from the thread's replies
+func (MessageService) Thread(ctx context.Context, userID, messageID string, q PageQuery) (ThreadPage, error) {
+	uid, err := parseID(userID, "user")
+	if err != nil {
+		return ThreadPage{}, err
+	}
+	root, err := findRoot(ctx, messageID)
+	if err != nil {
+		return ThreadPage{}, err
+	}
+	if err := authorize(ctx, ActionView, userID, root); err != nil {
+		return ThreadPage{}, err
+	}
+	page, err := loadPage(ctx, root.RoomID, bson.M{"threadId": root.ID, "hiddenFor": bson.M{"$ne": uid}}, q)
+	if err != nil {
+		return ThreadPage{}, err
+	}
+	result := ThreadPage{Root: root, Page: page}
+	for _, id := range root.ThreadFollowers {
+		if id == uid {
+			result.Following = true
+			break
+		}
+	}
+	return result, nil
+}
+
+// setFollowing adds or removes the user from the followers of a thread
+func setFollowing(ctx context.Context, userID, messageID string, follow bool) error {
+	uid, err := parseID(userID, "user")
+	if err != nil {
+		return err
+	}
+	root, err := findRoot(ctx, messageID)
+	if err != nil {
+		return err
+	}
+	if err := authorize(ctx, ActionFollow, userID, root); err != nil {
+		return err
+	}
+	update := bson.M{"$addToSet": bson.M{"threadFollowers": uid}}
+	if !follow {
+		update = bson.M{"$pull": bson.M{"threadFollowers": uid}}
+	}
+	if _, err := config.DB.Collection("messages").UpdateByID(ctx, root.ID, update); err != nil {
+		return internal("DB error")
+	}
+	return nil
+}
+
+// FollowThread notifies the user of new replies to a message, on every device
+func (MessageService) FollowThread(ctx context.Context, userID, messageID string) error {
+	return setFollowing(ctx, userID, messageID, true)
+}
+
+// UnfollowThread stops notifying the user of new replies to a message
+func (MessageService) UnfollowThread(ctx context.Context, userID, messageID string) error {
+	return setFollowing(ctx, userID, messageID, false)
+}
@@ -0,0 +1,37 @@
+package sockets
+
+import (
+	"context"
+	"errors"
+	"line/models"
+)
+
+// MessageActions performs the message actions clients request over the socket
+// It is implemented by the service layer the REST controllers use, so both paths share the same rules
+// and emit the same hub events; main wires it in through Actions
+type MessageActions interface {
+	Send(ctx context.Context, userID string, req MessageRequest) (MessageEvent, error)
+	React(ctx context.Context, userID, messageID, emoji string) error
+	Delete(ctx context.Context, userID, messageID string) error
+	Hide(ctx context.Context, userID, messageID string) error
+	Edit(ctx context.Context, userID, messageID, content string) (models.Message, error)
+	Forward(ctx context.Context, userID, messageID, toRoomID string) (models.Message, error)
+	Pin(ctx context.Context, userID, messageID string) error
+	Unpin(ctx context.Context, userID, messageID string) error
+	Star(ctx context.Context, userID, messageID string) error
+	Unstar(ctx context.Context, userID, messageID string) error
+	MarkRead(ctx context.Context, userID, roomID string) error
+	MarkDelivered(ctx context.Context, userID string, messageIDs []string) error
+}
+
+// Actions is the message service used by socket handlers
+var Actions MessageActions
+
+// errorCode returns the code of an action error, or ErrInternal for errors without one
+func errorCode(err error) string {
+	var coded interface{ Code() string }
+	if errors.As(err, &coded) {
+		return coded.Code()
+	}
+	return ErrInternal
+}
@@ -0,0 +1,90 @@
+package sockets
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"line/config"
+	"os"
+	"sync"
+)
+
+// BrokerMessage is a hub event as it travels between backend instances
+// Origin is the NodeID of the publishing instance
+// RoomID addresses the event to the room's subscribers, UserIDs to every connection of those users
+// SkipUser names a user whose connections must not receive the event (e.g. the typist)
+// Data is the JSON frame delivered to clients as is
+type BrokerMessage struct {
+	Origin   string          `json:"origin"`
+	Type     string          `json:"type"`
+	RoomID   string          `json:"roomId,omitempty"`
+	UserIDs  []string        `json:"userIds,omitempty"`
+	SkipUser string          `json:"skipUser,omitempty"`
+	Data     json.RawMessage `json:"data"`
+}
+
+// Broker carries hub events to every backend instance, including the one that published them
+// Subscribe registers the function called for each message and starts delivery; it is called once by Hub.Run
+type Broker interface {
+	Publish(ctx context.Context, msg BrokerMessage) error
+	Subscribe(handler func(BrokerMessage)) error
+	Close() error
+}
+
+// NodeID identifies this backend instance in broker messages
+var NodeID = newNodeID()
+
+func newNodeID() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "node"
+	}
+	return host + "-" + newSessionID()[:8]
+}
+
+// NewBroker builds the broker selected by HUB_BROKER ("local" or "mongo")
+func NewBroker() (Broker, error) {
+	switch kind := config.GetEnv("HUB_BROKER", "local"); kind {
+	case "local":
+		return NewLocalBroker(), nil
+	case "mongo":
+		return NewMongoBroker(config.DB, config.GetEnv("HUB_BROKER_COLLECTION", "hub_events"), int64(config.GetEnvInt("HUB_BROKER_SIZE_MB", 64))*1024*1024)
+	default:
+		return nil, fmt.Errorf("unknown HUB_BROKER %q", kind)
+	}
+}
+
+// LocalBroker delivers events only within this process
+type LocalBroker struct {
+	mu      sync.RWMutex
+	handler func(BrokerMessage)
+}
+
+// NewLocalBroker returns an in-process broker for single instance deployments
+func NewLocalBroker() *LocalBroker {
+	return &LocalBroker{}
+}
+
+// Publish hands the message straight to the subscribed handler
+func (b *LocalBroker) Publish(ctx context.Context, msg BrokerMessage) error {
+	b.mu.RLock()
+	handler := b.handler
+	b.mu.RUnlock()
+	if handler != nil {
+		handler(msg)
+	}
+	return nil
+}
+
+// Subscribe sets the handler for published messages
+func (b *LocalBroker) Subscribe(handler func(BrokerMessage)) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.handler = handler
+	return nil
+}
+
+// Close is a no-op for the in-process broker
+func (b *LocalBroker) Close() error {
+	return nil
+}
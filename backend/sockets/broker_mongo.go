@@ -0,0 +1,149 @@
+package sockets
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// MongoBroker shares hub events between instances through a capped collection
+// Every instance inserts the events it publishes and tails the collection for the others' events
+// Tailing works on a standalone mongod, unlike change streams which need a replica set
+type MongoBroker struct {
+	coll    *mongo.Collection
+	handler func(BrokerMessage)
+	cancel  context.CancelFunc
+	done    chan struct{}
+	once    sync.Once
+}
+
+// brokerDoc is the stored form of a BrokerMessage
+// Ts is inserted empty so the server stamps it; unlike _id, which each instance generates, it increases
+// in insert order across instances and is what the tail resumes from
+type brokerDoc struct {
+	ID        primitive.ObjectID  `bson:"_id,omitempty"`
+	Ts        primitive.Timestamp `bson:"ts"`
+	Origin    string              `bson:"origin"`
+	Type      string              `bson:"type"`
+	RoomID    string              `bson:"roomId,omitempty"`
+	UserIDs   []string            `bson:"userIds,omitempty"`
+	SkipUser  string              `bson:"skipUser,omitempty"`
+	Data      []byte              `bson:"data"`
+	CreatedAt time.Time           `bson:"createdAt"`
+}
+
+// NewMongoBroker creates the capped collection if needed and returns a broker using it
+func NewMongoBroker(db *mongo.Database, collection string, sizeBytes int64) (*MongoBroker, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	opts := options.CreateCollection().SetCapped(true).SetSizeInBytes(sizeBytes)
+	err := db.CreateCollection(ctx, collection, opts)
+	var cmdErr mongo.CommandError
+	if err != nil && !(errors.As(err, &cmdErr) && cmdErr.Name == "NamespaceExists") {
+		return nil, err
+	}
+	return &MongoBroker{coll: db.Collection(collection), done: make(chan struct{})}, nil
+}
+
+// Publish delivers the message locally right away and stores it for the other instances
+func (b *MongoBroker) Publish(ctx context.Context, msg BrokerMessage) error {
+	if b.handler != nil {
+		b.handler(msg)
+	}
+	_, err := b.coll.InsertOne(ctx, brokerDoc{
+		Origin:    msg.Origin,
+		Type:      msg.Type,
+		RoomID:    msg.RoomID,
+		UserIDs:   msg.UserIDs,
+		SkipUser:  msg.SkipUser,
+		Data:      msg.Data,
+		CreatedAt: time.Now(),
+	})
+	return err
+}
+
+// Subscribe starts tailing the collection from its current end
+func (b *MongoBroker) Subscribe(handler func(BrokerMessage)) error {
+	b.handler = handler
+	ctx, cancel := context.WithCancel(context.Background())
+	b.cancel = cancel
+
+	// Only events published after we started are of interest
+	var last brokerDoc
+	err := b.coll.FindOne(ctx, bson.M{}, options.FindOne().SetSort(bson.M{"$natural": -1})).Decode(&last)
+	if err != nil && err != mongo.ErrNoDocuments {
+		cancel()
+		return err
+	}
+	go b.tail(ctx, last.Ts)
+	return nil
+}
+
+// tail follows the capped collection, reopening the cursor whenever it dies
+// Documents stored before ts was added have none and never match, so an old collection is not replayed
+func (b *MongoBroker) tail(ctx context.Context, lastTs primitive.Timestamp) {
+	defer close(b.done)
+	for ctx.Err() == nil {
+		filter := bson.M{"ts": bson.M{"$gt": lastTs}}
+		opts := options.Find().SetCursorType(options.TailableAwait).SetMaxAwaitTime(time.Second)
+		cursor, err := b.coll.Find(ctx, filter, opts)
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Println("Broker tail error:", err)
+			}
+			sleepCtx(ctx, time.Second)
+			continue
+		}
+		for cursor.Next(ctx) {
+			var doc brokerDoc
+			if err := cursor.Decode(&doc); err != nil {
+				log.Println("Broker decode error:", err)
+				continue
+			}
+			lastTs = doc.Ts
+			if doc.Origin == NodeID {
+				continue
+			}
+			b.handler(BrokerMessage{
+				Origin:   doc.Origin,
+				Type:     doc.Type,
+				RoomID:   doc.RoomID,
+				UserIDs:  doc.UserIDs,
+				SkipUser: doc.SkipUser,
+				Data:     doc.Data,
+			})
+		}
+		if err := cursor.Err(); err != nil && ctx.Err() == nil {
+			log.Println("Broker cursor error:", err)
+		}
+		cursor.Close(context.Background())
+		// An empty capped collection yields a dead cursor straight away, so back off before retrying
+		sleepCtx(ctx, 500*time.Millisecond)
+	}
+}
+
+// Close stops tailing and waits for the tail goroutine to exit
+func (b *MongoBroker) Close() error {
+	b.once.Do(func() {
+		if b.cancel != nil {
+			b.cancel()
+			<-b.done
+		}
+	})
+	return nil
+}
+
+// sleepCtx waits for d or until ctx is cancelled
+func sleepCtx(ctx context.Context, d time.Duration) {
+	select {
+	case <-ctx.Done():
+	case <-time.After(d):
+	}
+}
@@ -1,25 +1,89 @@
 package sockets
 
 import (
-	"context"
-	"encoding/json"
-	"line/config"
+	"errors"
 	"line/models"
+	"log"
+	"net"
+	"sync"
 	"time"
 
 	"github.com/gorilla/websocket"
-	"go.mongodb.org/mongo-driver/bson"
-	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
-// Client represents a WebSocket client
+// Transports a client can be connected through
+const (
+	TransportWebSocket = "websocket"
+	TransportSSE       = "sse"
+	TransportPoll      = "poll"
+)
+
+// Client represents a single real-time connection of a user
+// Conn is only set for the WebSocket transport; SSE and long-poll clients are drained by their HTTP handlers
+// SessionID is unique per connection, DeviceID is supplied by the client to tell its devices apart
+// Version is the protocol version negotiated on connect
+// Rooms holds the IDs of the rooms the client is subscribed to and is guarded by the hub mutex
 type Client struct {
-	Conn   *websocket.Conn
-	UserID string
-	RoomID string
-	Send   chan interface{}
+	Conn      *websocket.Conn
+	Transport string
+	UserID    string
+	SessionID string
+	DeviceID  string
+	Version   int
+	Rooms     map[string]bool
+	Send      chan interface{}
+	done      chan struct{}
+	closeOnce sync.Once
+
+	// Rate limit strikes; fallback transports may handle frames concurrently
+	strikeMu     sync.Mutex
+	strikes      int
+	strikesSince time.Time
+
+	// Presence of this session; storedStatus is the status last written to the presence collection
+	presenceMu   sync.Mutex
+	lastActive   time.Time
+	away         bool
+	storedStatus string
+}
+
+// newClient builds a client with a fresh session ID and registers it with the hub
+// An empty deviceID defaults to the session ID; the hello frame is queued before any hub event
+func newClient(conn *websocket.Conn, transport, userID, deviceID string, version int) *Client {
+	sessionID := newSessionID()
+	if deviceID == "" {
+		deviceID = sessionID
+	}
+	client := &Client{
+		Conn:      conn,
+		Transport: transport,
+		UserID:    userID,
+		SessionID: sessionID,
+		DeviceID:  deviceID,
+		Version:   version,
+		Rooms:     make(map[string]bool),
+		Send:      make(chan interface{}, Opts.SendQueueSize),
+		done:      make(chan struct{}),
+	}
+	client.enqueue(HelloEvent{Type: "hello", V: version, Versions: []int{ProtocolLegacy, ProtocolV1}, SessionID: sessionID, DeviceID: deviceID})
+	H.Register(client)
+	client.connectPresence()
+	return client
 }
 
+// release unregisters a closed client and drops its presence session
+// Send is never closed: a fallback frame may still be in flight for the client, so shutdown is signalled
+// through done alone and late frames are dropped by enqueue
+// The offline presence is handed to the hub before the client is unregistered, so Shutdown, which waits
+// for every client to be unregistered, cannot stop the hub while it is still pending
+func (c *Client) release() {
+	c.close()
+	c.disconnectPresence()
+	H.Unregister(c)
+}
+
+// MessageEvent announces a new message
+// Like the other stored room events it carries Seq, the per-room sequence clients send back in a resume frame
 type MessageEvent struct {
 	Type           string                     `json:"type"`
 	ID             string                     `json:"id"`
@@ -28,22 +92,57 @@ type MessageEvent struct {
 	SenderID       string                     `json:"senderId"`
 	Content        string                     `json:"content"`
 	MediaURL       string                     `json:"mediaUrl,omitempty"`
+	Mentions       []models.Mention           `json:"mentions,omitempty"`
 	Timestamp      time.Time                  `json:"timestamp"`
 	ReplyTo        string                     `json:"replyTo,omitempty"`
+	ThreadID       string                     `json:"threadId,omitempty"`
 	RepliedMessage *models.RepliedMessageInfo `json:"repliedMessage,omitempty"`
+	Seq            int64                      `json:"seq,omitempty"`
+}
+
+// ThreadEvent announces a reply in a thread along with the thread's new summary
+// The room gets it as "thread_reply" in place of a message event; Followers other than the sender also
+// get it as "thread_notification" on every connection, whether or not they are subscribed to the room
+type ThreadEvent struct {
+	Type        string       `json:"type"`
+	RoomID      string       `json:"roomId"`
+	ThreadID    string       `json:"threadId"`
+	Reply       MessageEvent `json:"reply"`
+	ReplyCount  int          `json:"replyCount"`
+	LastReplyAt time.Time    `json:"lastReplyAt"`
+	Seq         int64        `json:"seq,omitempty"`
+	Followers   []string     `json:"-"`
 }
 
+// MentionEvent tells users they were mentioned in a message
+// It is pushed to every connection of the users in To, whether or not they are subscribed to the room
+type MentionEvent struct {
+	Type      string    `json:"type"`
+	RoomID    string    `json:"roomId"`
+	MessageID string    `json:"messageId"`
+	ThreadID  string    `json:"threadId,omitempty"`
+	SenderID  string    `json:"senderId"`
+	Content   string    `json:"content"`
+	Timestamp time.Time `json:"timestamp"`
+	To        []string  `json:"-"`
+}
+
+// TypingEvent is a typing_start or typing_stop sent through the hub
+// Clients receive the aggregated TypingStateEvent, plus a "typing" event for each start
 type TypingEvent struct {
 	Type   string `json:"type"`
 	RoomID string `json:"roomId"`
 	UserID string `json:"userId"`
 }
 
+// PresenceEvent announces a user's change to online, away or offline
+// To lists the users it is pushed to: the user's contacts and everyone sharing a room with them
 type PresenceEvent struct {
-	Type   string `json:"type"`
-	RoomID string `json:"roomId"`
-	UserID string `json:"userId"`
-	Status string `json:"status"`
+	Type     string     `json:"type"`
+	UserID   string     `json:"userId"`
+	Status   string     `json:"status"`
+	LastSeen *time.Time `json:"lastSeen,omitempty"`
+	To       []string   `json:"-"`
 }
 
 type ReactionEvent struct {
@@ -52,6 +151,7 @@ type ReactionEvent struct {
 	MessageID string `json:"messageId"`
 	Emoji     string `json:"emoji"`
 	UserID    string `json:"userId"`
+	Seq       int64  `json:"seq,omitempty"`
 }
 
 type PinEvent struct {
@@ -59,6 +159,7 @@ type PinEvent struct {
 	RoomID    string         `json:"roomId"`
 	MessageID string         `json:"messageId"`
 	Message   models.Message `json:"message"`
+	Seq       int64          `json:"seq,omitempty"`
 }
 
 type StarEvent struct {
@@ -66,12 +167,36 @@ type StarEvent struct {
 	RoomID    string         `json:"roomId"`
 	MessageID string         `json:"messageId"`
 	Message   models.Message `json:"message"`
+	Seq       int64          `json:"seq,omitempty"`
 }
 
+// Scopes of a delete
+const (
+	DeleteForEveryone = "everyone"
+	DeleteForMe       = "me"
+)
+
+// DeleteEvent removes a message from view
+// With scope "everyone" the room gets it and the message becomes a tombstone; with "me" only the
+// user's own devices get it
 type DeleteEvent struct {
 	Type      string `json:"type"`
+	Scope     string `json:"scope"`
 	RoomID    string `json:"roomId"`
 	MessageID string `json:"messageId"`
+	DeletedBy string `json:"deletedBy,omitempty"`
+	Seq       int64  `json:"seq,omitempty"`
+}
+
+// EditEvent carries the new content of an edited message and the mentions parsed from it
+type EditEvent struct {
+	Type      string           `json:"type"`
+	RoomID    string           `json:"roomId"`
+	MessageID string           `json:"messageId"`
+	Content   string           `json:"content"`
+	Mentions  []models.Mention `json:"mentions,omitempty"`
+	EditedAt  time.Time        `json:"editedAt"`
+	Seq       int64            `json:"seq,omitempty"`
 }
 
 type ForwardEvent struct {
@@ -79,178 +204,158 @@ type ForwardEvent struct {
 	RoomID    string         `json:"roomId"`
 	MessageID string         `json:"messageId"`
 	Message   models.Message `json:"message"`
+	Seq       int64          `json:"seq,omitempty"`
+}
+
+// ReadEvent tells room members that UserID has read every message up to UpToMessageID
+type ReadEvent struct {
+	Type          string    `json:"type"`
+	RoomID        string    `json:"roomId"`
+	UserID        string    `json:"userId"`
+	UpToMessageID string    `json:"upToMessageId"`
+	At            time.Time `json:"at"`
+	Seq           int64     `json:"seq,omitempty"`
+}
+
+// DeliveredEvent tells a sender that their messages reached a device of UserID
+type DeliveredEvent struct {
+	Type       string    `json:"type"`
+	RoomID     string    `json:"roomId"`
+	SenderID   string    `json:"senderId"`
+	UserID     string    `json:"userId"`
+	MessageIDs []string  `json:"messageIds"`
+	At         time.Time `json:"at"`
 }
 
 // ReadPump reads messages from the WebSocket connection
 func (c *Client) ReadPump() {
 	defer func() {
-		c.Conn.Close()
+		c.close()
 	}()
 
+	c.Conn.SetReadLimit(Opts.MaxMessageSize)
+	c.Conn.SetReadDeadline(time.Now().Add(Opts.PongWait))
+	c.Conn.SetPongHandler(func(string) error {
+		c.Conn.SetReadDeadline(time.Now().Add(Opts.PongWait))
+		return nil
+	})
+
 	for {
 		_, message, err := c.Conn.ReadMessage()
 		if err != nil {
+			c.handleReadError(err)
 			break
 		}
+		c.Conn.SetReadDeadline(time.Now().Add(Opts.PongWait))
 
-		var event map[string]interface{}
-		if err := json.Unmarshal(message, &event); err != nil {
+		if !beginWork() {
 			continue
 		}
+		c.handleFrame(message)
+		endWork()
+	}
+}
 
-		switch event["type"] {
-		case "message":
-			roomID := event["roomId"].(string)
-			content := event["content"].(string)
-			mediaURL := ""
-			if val, ok := event["mediaUrl"].(string); ok {
-				mediaURL = val
-			}
-			replyTo := ""
-			if val, ok := event["replyTo"].(string); ok {
-				replyTo = val
-			}
-			clientSideID := ""
-			if id, ok := event["clientSideId"].(string); ok {
-				clientSideID = id
-			}
-
-			// Save to DB
-			rid, _ := primitive.ObjectIDFromHex(roomID)
-			sid, _ := primitive.ObjectIDFromHex(c.UserID)
-			newMsg := models.Message{
-				RoomID:    rid,
-				SenderID:  sid,
-				Content:   content,
-				MediaURL:  mediaURL,
-				Timestamp: time.Now(),
-				ReadBy:    []primitive.ObjectID{},
-				Reactions: map[string][]primitive.ObjectID{},
-			}
-
-			if replyTo != "" {
-				replyToID, err := primitive.ObjectIDFromHex(replyTo)
-				if err == nil {
-					newMsg.ReplyTo = &replyToID
-				}
-			}
-
-			res, err := config.DB.Collection("messages").InsertOne(context.Background(), newMsg)
-			if err != nil {
-				// Handle insert error
-				continue
-			}
-			newMsgID := res.InsertedID.(primitive.ObjectID)
-
-			// Use aggregation to fetch the full message details to ensure consistency
-			pipeline := []bson.M{
-				{"$match": bson.M{"_id": newMsgID}},
-				{"$limit": 1},
-				{"$lookup": bson.M{"from": "messages", "localField": "replyTo", "foreignField": "_id", "as": "repliedMessageDocs"}},
-				{"$lookup": bson.M{"from": "users", "localField": "repliedMessageDocs.senderId", "foreignField": "_id", "as": "repliedMessageSenders"}},
-				{"$addFields": bson.M{
-					"repliedMessage": bson.M{
-						"$cond": bson.M{
-							"if": bson.M{"$gt": bson.A{bson.M{"$size": "$repliedMessageDocs"}, 0}},
-							"then": bson.M{
-								"senderId":   bson.M{"$toString": bson.M{"$arrayElemAt": bson.A{"$repliedMessageDocs.senderId", 0}}},
-								"senderName": bson.M{"$arrayElemAt": bson.A{"$repliedMessageSenders.username", 0}},
-								"content":    bson.M{"$arrayElemAt": bson.A{"$repliedMessageDocs.content", 0}},
-								"mediaUrl":   bson.M{"$arrayElemAt": bson.A{"$repliedMessageDocs.mediaUrl", 0}},
-							},
-							"else": nil,
-						},
-					},
-				}},
-				{"$project": bson.M{"repliedMessageDocs": 0, "repliedMessageSenders": 0}},
-			}
+// enqueue queues a frame for the client without blocking
+// Frames for a closed client are dropped; when the queue is full the frame is dropped too and,
+// under the disconnect policy, the client is evicted
+func (c *Client) enqueue(msg interface{}) bool {
+	if c.closed() {
+		return false
+	}
+	select {
+	case <-c.done:
+		return false
+	case c.Send <- msg:
+		H.sent.Add(1)
+		return true
+	default:
+		H.dropped.Add(1)
+		if Opts.SlowConsumer == PolicyDisconnect {
+			H.evicted.Add(1)
+			log.Printf("Evicting slow socket consumer user=%s session=%s", c.UserID, c.SessionID)
+			c.closeWith(CloseSlowConsumer, "slow consumer")
+		}
+		return false
+	}
+}
 
-			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-			defer cancel()
+// closed reports whether the client has been closed
+func (c *Client) closed() bool {
+	select {
+	case <-c.done:
+		return true
+	default:
+		return false
+	}
+}
 
-			cursor, err := config.DB.Collection("messages").Aggregate(ctx, pipeline)
-			if err != nil {
-				continue // handle error
-			}
-			var fullMessages []models.Message
-			if err = cursor.All(ctx, &fullMessages); err != nil || len(fullMessages) == 0 {
-				continue // handle error
-			}
-			fullMessage := fullMessages[0]
-
-			// Create message event for broadcast
-			msgEvent := MessageEvent{
-				Type:           "message",
-				ID:             fullMessage.ID.Hex(),
-				ClientSideID:   clientSideID,
-				RoomID:         fullMessage.RoomID.Hex(),
-				SenderID:       fullMessage.SenderID.Hex(),
-				Content:        fullMessage.Content,
-				MediaURL:       fullMessage.MediaURL,
-				Timestamp:      fullMessage.Timestamp,
-				RepliedMessage: fullMessage.RepliedMessage,
-			}
-			if fullMessage.ReplyTo != nil {
-				msgEvent.ReplyTo = fullMessage.ReplyTo.Hex()
-			}
+// close shuts the connection once, which ends its reader and unregisters the client
+func (c *Client) close() {
+	c.closeWith(0, "")
+}
 
-			H.Broadcast <- msgEvent
-		case "typing":
-			roomID := event["roomId"].(string)
-			H.Typing <- TypingEvent{Type: "typing", RoomID: roomID, UserID: c.UserID}
-		case "reaction":
-			roomID := event["roomId"].(string)
-			messageID := event["messageId"].(string)
-			emoji := event["emoji"].(string)
-			userID := c.UserID
-			// Update message in DB
-			mid, _ := primitive.ObjectIDFromHex(messageID)
-			var msg models.Message
-			err := config.DB.Collection("messages").FindOne(context.Background(), bson.M{"_id": mid}).Decode(&msg)
-			if err == nil {
-				if msg.Reactions == nil {
-					msg.Reactions = make(map[string][]primitive.ObjectID)
-				}
-				uid, _ := primitive.ObjectIDFromHex(userID)
-				found := false
-				for _, id := range msg.Reactions[emoji] {
-					if id == uid {
-						found = true
-						break
-					}
-				}
-				if !found {
-					msg.Reactions[emoji] = append(msg.Reactions[emoji], uid)
-				} else {
-					// Remove reaction
-					newArr := []primitive.ObjectID{}
-					for _, id := range msg.Reactions[emoji] {
-						if id != uid {
-							newArr = append(newArr, id)
-						}
-					}
-					if len(newArr) == 0 {
-						delete(msg.Reactions, emoji)
-					} else {
-						msg.Reactions[emoji] = newArr
-					}
-				}
-				config.DB.Collection("messages").UpdateOne(context.Background(), bson.M{"_id": mid}, bson.M{"$set": bson.M{"reactions": msg.Reactions}})
-				H.Reaction <- ReactionEvent{
-					Type:      "reaction",
-					RoomID:    roomID,
-					MessageID: messageID,
-					Emoji:     emoji,
-					UserID:    userID,
-				}
-			}
+// closeWith sends a close frame with the given code before shutting the connection
+// Code 0 closes without a frame; fallback transports have no close frame and just stop
+// It never blocks: the hub evicts slow consumers while holding its lock, and writing the frame
+// waits on the connection's write lock, which a stalled WritePump may hold for up to WriteWait
+func (c *Client) closeWith(code int, reason string) {
+	c.closeOnce.Do(func() {
+		close(c.done)
+		if c.Conn == nil {
+			return
 		}
+		if code == 0 {
+			c.Conn.Close()
+			return
+		}
+		go func() {
+			msg := websocket.FormatCloseMessage(code, reason)
+			c.Conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(Opts.WriteWait))
+			c.Conn.Close()
+		}()
+	})
+}
+
+// handleReadError closes the connection with a code matching why reading stopped
+func (c *Client) handleReadError(err error) {
+	var netErr net.Error
+	switch {
+	case errors.Is(err, websocket.ErrReadLimit):
+		// gorilla has already sent CloseMessageTooBig to the peer
+		log.Printf("Socket frame too large user=%s session=%s", c.UserID, c.SessionID)
+		c.close()
+	case errors.As(err, &netErr) && netErr.Timeout():
+		c.closeWith(CloseIdleTimeout, "idle timeout")
+	case websocket.IsUnexpectedCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway, websocket.CloseNoStatusReceived):
+		log.Printf("Socket closed unexpectedly user=%s session=%s: %v", c.UserID, c.SessionID, err)
 	}
 }
 
-// WritePump writes messages to the WebSocket connection
+// WritePump writes messages to the WebSocket connection and pings the peer to keep it alive
 func (c *Client) WritePump() {
-	for msg := range c.Send {
-		c.Conn.WriteJSON(msg)
+	ticker := time.NewTicker(Opts.PingPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case msg := <-c.Send:
+			c.Conn.SetWriteDeadline(time.Now().Add(Opts.WriteWait))
+			if err := c.Conn.WriteJSON(msg); err != nil {
+				c.close()
+				return
+			}
+		case <-ticker.C:
+			c.Conn.SetWriteDeadline(time.Now().Add(Opts.WriteWait))
+			if err := c.Conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				c.close()
+				return
+			}
+		case <-lifecycle.goingAway:
+			c.flush()
+			c.closeWith(websocket.CloseGoingAway, "server shutting down")
+			return
+		}
 	}
 }
@@ -0,0 +1,360 @@
+package sockets
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+)
+
+// handleFrame decodes one inbound frame and routes it to the handler for its type
+// Problems are reported to the client as error frames; they never end the connection
+func (c *Client) handleFrame(raw []byte) {
+	env, errEvent := decodeEnvelope(raw, c.Version)
+	if errEvent != nil {
+		c.enqueue(*errEvent)
+		return
+	}
+
+	// Payloads that fail to decode here are reported by the handler for the frame type
+	var refs roomRefs
+	json.Unmarshal(env.Payload, &refs)
+	// The user's bucket is charged first and the room's only once membership is checked, so a
+	// non-member cannot drain a room's bucket; rooms of subscription frames are never charged
+	if !c.allowUser(env) {
+		return
+	}
+	if !c.authorizeRooms(env, refs) {
+		return
+	}
+	if !subscriptionFrames[env.Type] && !c.allowRoom(env, refs.RoomID) {
+		return
+	}
+	if env.Type != "heartbeat" {
+		c.markActive()
+	}
+
+	switch env.Type {
+	case "join", "leave":
+		var req JoinRequest
+		if errEvent := decodePayload(env, &req); errEvent != nil {
+			c.enqueue(*errEvent)
+			return
+		}
+		if env.Type == "join" {
+			c.subscribe(env, []string{req.RoomID})
+		} else {
+			c.unsubscribe(env, []string{req.RoomID})
+		}
+	case "subscribe", "unsubscribe":
+		var req SubscribeRequest
+		if errEvent := decodePayload(env, &req); errEvent != nil {
+			c.enqueue(*errEvent)
+			return
+		}
+		if env.Type == "subscribe" {
+			c.subscribe(env, req.RoomIDs)
+		} else {
+			c.unsubscribe(env, req.RoomIDs)
+		}
+	case "resume":
+		var req ResumeRequest
+		if errEvent := decodePayload(env, &req); errEvent != nil {
+			c.enqueue(*errEvent)
+			return
+		}
+		c.resume(env, req.Rooms)
+	case "message":
+		var req MessageRequest
+		if errEvent := decodePayload(env, &req); errEvent != nil {
+			c.enqueue(*errEvent)
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		msg, err := Actions.Send(ctx, c.UserID, req)
+		if err != nil {
+			c.fail(env, errorCode(err), err.Error(), req.RoomID)
+			return
+		}
+		c.enqueue(AckEvent{Type: "ack", Action: env.Type, ID: env.ID, MessageID: msg.ID, ClientSideID: req.ClientSideID})
+	case "typing", "typing_start", "typing_stop":
+		var req TypingRequest
+		if errEvent := decodePayload(env, &req); errEvent != nil {
+			c.enqueue(*errEvent)
+			return
+		}
+		if req.RoomID == "" {
+			c.fail(env, ErrBadRequest, "roomId is required", "")
+			return
+		}
+		eventType := "typing_start"
+		if env.Type == "typing_stop" {
+			eventType = "typing_stop"
+		}
+		H.Typing <- TypingEvent{Type: eventType, RoomID: req.RoomID, UserID: c.UserID}
+	case "reaction":
+		var req ReactionRequest
+		if errEvent := decodePayload(env, &req); errEvent != nil {
+			c.enqueue(*errEvent)
+			return
+		}
+		c.runAction(env, req.RoomID, req.MessageID, func(ctx context.Context) error {
+			return Actions.React(ctx, c.UserID, req.MessageID, req.Emoji)
+		})
+	case "pin", "unpin", "star", "unstar", "delete":
+		var req MessageActionRequest
+		if errEvent := decodePayload(env, &req); errEvent != nil {
+			c.enqueue(*errEvent)
+			return
+		}
+		actions := map[string]func(context.Context, string, string) error{
+			"pin":    Actions.Pin,
+			"unpin":  Actions.Unpin,
+			"star":   Actions.Star,
+			"unstar": Actions.Unstar,
+			"delete": Actions.Delete,
+		}
+		action := actions[env.Type]
+		if env.Type == "delete" {
+			switch req.Scope {
+			case "", DeleteForEveryone:
+			case DeleteForMe:
+				action = Actions.Hide
+			default:
+				c.fail(env, ErrBadRequest, "scope must be me or everyone", req.RoomID)
+				return
+			}
+		}
+		c.runAction(env, req.RoomID, req.MessageID, func(ctx context.Context) error {
+			return action(ctx, c.UserID, req.MessageID)
+		})
+	case "edit":
+		var req EditRequest
+		if errEvent := decodePayload(env, &req); errEvent != nil {
+			c.enqueue(*errEvent)
+			return
+		}
+		c.runAction(env, req.RoomID, req.MessageID, func(ctx context.Context) error {
+			_, err := Actions.Edit(ctx, c.UserID, req.MessageID, req.Content)
+			return err
+		})
+	case "forward":
+		var req ForwardRequest
+		if errEvent := decodePayload(env, &req); errEvent != nil {
+			c.enqueue(*errEvent)
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		msg, err := Actions.Forward(ctx, c.UserID, req.MessageID, req.ToRoomID)
+		if err != nil {
+			c.fail(env, errorCode(err), err.Error(), req.ToRoomID)
+			return
+		}
+		c.enqueue(AckEvent{Type: "ack", Action: env.Type, ID: env.ID, MessageID: msg.ID.Hex()})
+	case "read":
+		var req ReadRequest
+		if errEvent := decodePayload(env, &req); errEvent != nil {
+			c.enqueue(*errEvent)
+			return
+		}
+		c.runAction(env, req.RoomID, "", func(ctx context.Context) error {
+			return Actions.MarkRead(ctx, c.UserID, req.RoomID)
+		})
+	case "heartbeat":
+		var req HeartbeatRequest
+		if errEvent := decodePayload(env, &req); errEvent != nil {
+			c.enqueue(*errEvent)
+			return
+		}
+		if req.Status != "" && req.Status != StatusOnline && req.Status != StatusAway {
+			c.fail(env, ErrBadRequest, "status must be online or away", "")
+			return
+		}
+		c.touch(req.Status == StatusAway)
+		c.runAction(env, "", "", c.syncPresence)
+	case "delivered":
+		var req DeliveredRequest
+		if errEvent := decodePayload(env, &req); errEvent != nil {
+			c.enqueue(*errEvent)
+			return
+		}
+		c.runAction(env, req.RoomID, "", func(ctx context.Context) error {
+			return Actions.MarkDelivered(ctx, c.UserID, req.MessageIDs)
+		})
+	default:
+		c.fail(env, ErrUnknownType, "Unknown frame type "+env.Type, "")
+	}
+}
+
+// frameTypes are the frame types handleFrame dispatches
+var frameTypes = map[string]bool{
+	"join": true, "leave": true, "subscribe": true, "unsubscribe": true, "resume": true,
+	"message": true, "typing": true, "typing_start": true, "typing_stop": true, "reaction": true,
+	"pin": true, "unpin": true, "star": true, "unstar": true, "delete": true, "edit": true,
+	"forward": true, "read": true, "heartbeat": true, "delivered": true,
+}
+
+// subscriptionFrames check the membership of each of their rooms themselves
+var subscriptionFrames = map[string]bool{
+	"join": true, "subscribe": true, "resume": true, "leave": true, "unsubscribe": true,
+}
+
+// roomRefs holds the room fields any request payload may carry
+type roomRefs struct {
+	RoomID   string `json:"roomId"`
+	ToRoomID string `json:"toRoomId"`
+}
+
+// authorizeRooms rejects a frame naming a room the user is not a member of
+// Subscription frames check each of their rooms themselves and leaving is always allowed;
+// actions addressed by message ID are checked against the message's room by the service layer
+func (c *Client) authorizeRooms(env Envelope, refs roomRefs) bool {
+	if subscriptionFrames[env.Type] {
+		return true
+	}
+	for _, roomID := range []string{refs.RoomID, refs.ToRoomID} {
+		if roomID == "" {
+			continue
+		}
+		ok, err := IsMember(roomID, c.UserID)
+		if err != nil {
+			c.fail(env, ErrInternal, "Could not verify room membership", roomID)
+			return false
+		}
+		if !ok {
+			c.fail(env, ErrNotMember, "Not a member of this room", roomID)
+			return false
+		}
+	}
+	return true
+}
+
+// fail sends an error frame answering the given request
+func (c *Client) fail(env Envelope, code, message, roomID string) {
+	c.enqueue(ErrorEvent{Type: "error", Action: env.Type, ID: env.ID, Code: code, Message: message, RoomID: roomID})
+}
+
+// subscribe joins the client to every room it is a member of and acks the result
+func (c *Client) subscribe(env Envelope, roomIDs []string) {
+	roomIDs = nonEmpty(roomIDs)
+	if len(roomIDs) == 0 {
+		c.fail(env, ErrBadRequest, "No room IDs given", "")
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	accepted := []string{}
+	rejected := []string{}
+	seqs := map[string]int64{}
+	for _, roomID := range roomIDs {
+		ok, err := IsMember(roomID, c.UserID)
+		if err != nil {
+			c.fail(env, ErrInternal, "Could not verify room membership", roomID)
+			return
+		}
+		if !ok {
+			rejected = append(rejected, roomID)
+			continue
+		}
+		if !H.Join(c, roomID) {
+			// Released while the frame was in flight; nobody is left to ack
+			return
+		}
+		if typists := H.typists.snapshot(roomID); len(typists) > 0 {
+			c.enqueue(TypingStateEvent{Type: "typing_state", RoomID: roomID, UserIDs: typists})
+		}
+		accepted = append(accepted, roomID)
+		if seq, err := currentSeq(ctx, roomID); err == nil {
+			seqs[roomID] = seq
+		}
+	}
+	if len(accepted) == 0 && env.Type == "join" {
+		c.fail(env, ErrNotMember, "Not a member of this room", roomIDs[0])
+		return
+	}
+	c.enqueue(AckEvent{Type: "ack", Action: env.Type, ID: env.ID, RoomIDs: accepted, Rejected: rejected, Seqs: seqs})
+}
+
+// resume subscribes to the given rooms and replays the events the client missed in each
+// The room is joined before the log is read, so an event may arrive both live and replayed;
+// clients drop events whose seq is not above the last one they applied. With several instances
+// live events of a room can arrive out of order, so clients hold an event that skips a seq and
+// send resume if the gap is not filled shortly
+func (c *Client) resume(env Envelope, lastSeen map[string]int64) {
+	if len(lastSeen) == 0 {
+		c.fail(env, ErrBadRequest, "No rooms given", "")
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	replayed := []string{}
+	rejected := []string{}
+	resync := []string{}
+	seqs := map[string]int64{}
+	for roomID, after := range lastSeen {
+		ok, err := IsMember(roomID, c.UserID)
+		if err != nil {
+			c.fail(env, ErrInternal, "Could not verify room membership", roomID)
+			return
+		}
+		if !ok {
+			rejected = append(rejected, roomID)
+			continue
+		}
+		if !H.Join(c, roomID) {
+			return
+		}
+		current, err := currentSeq(ctx, roomID)
+		if err != nil {
+			c.fail(env, ErrInternal, "Could not read room sequence", roomID)
+			return
+		}
+		seqs[roomID] = current
+		events, complete, err := eventsAfter(ctx, roomID, after, current)
+		if err != nil || !complete {
+			resync = append(resync, roomID)
+			continue
+		}
+		for _, ev := range events {
+			c.enqueue(json.RawMessage(ev.Data))
+		}
+		replayed = append(replayed, roomID)
+	}
+	c.enqueue(AckEvent{Type: "ack", Action: env.Type, ID: env.ID, RoomIDs: replayed, Rejected: rejected, Resync: resync, Seqs: seqs})
+}
+
+// unsubscribe removes the client from the given rooms and acks the result
+func (c *Client) unsubscribe(env Envelope, roomIDs []string) {
+	roomIDs = nonEmpty(roomIDs)
+	if len(roomIDs) == 0 {
+		c.fail(env, ErrBadRequest, "No room IDs given", "")
+		return
+	}
+	for _, roomID := range roomIDs {
+		H.Leave(c, roomID)
+	}
+	c.enqueue(AckEvent{Type: "ack", Action: env.Type, ID: env.ID, RoomIDs: roomIDs})
+}
+
+// nonEmpty drops blank entries from a list of IDs
+func nonEmpty(ids []string) []string {
+	out := []string{}
+	for _, id := range ids {
+		if id != "" {
+			out = append(out, id)
+		}
+	}
+	return out
+}
+
+// runAction runs a message action and answers the request with an ack or an error frame
+func (c *Client) runAction(env Envelope, roomID, messageID string, action func(ctx context.Context) error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := action(ctx); err != nil {
+		c.fail(env, errorCode(err), err.Error(), roomID)
+		return
+	}
+	c.enqueue(AckEvent{Type: "ack", Action: env.Type, ID: env.ID, MessageID: messageID})
+}
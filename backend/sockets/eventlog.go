@@ -0,0 +1,113 @@
+package sockets
+
+import (
+	"context"
+	"encoding/json"
+	"line/config"
+	"log"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// roomEvent is a logged room event kept for replay after a reconnect
+type roomEvent struct {
+	RoomID    string    `bson:"roomId"`
+	Seq       int64     `bson:"seq"`
+	Type      string    `bson:"type"`
+	Data      []byte    `bson:"data"`
+	CreatedAt time.Time `bson:"createdAt"`
+}
+
+// EnsureEventLog creates the indexes of the room event log
+// Entries expire after Opts.EventLogTTL, after which reconnecting clients have to resync
+func EnsureEventLog() {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	_, err := config.DB.Collection("room_events").Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "roomId", Value: 1}, {Key: "seq", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+		{
+			Keys:    bson.M{"createdAt": 1},
+			Options: options.Index().SetExpireAfterSeconds(int32(Opts.EventLogTTL.Seconds())),
+		},
+	})
+	if err != nil {
+		log.Println("Could not create indexes for room_events:", err)
+	}
+}
+
+// nextSeq increments and returns the sequence of a room, or 0 if it could not be stored
+func nextSeq(roomID string) int64 {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var doc struct {
+		Seq int64 `bson:"seq"`
+	}
+	opts := options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)
+	err := config.DB.Collection("room_sequences").FindOneAndUpdate(ctx, bson.M{"_id": roomID}, bson.M{"$inc": bson.M{"seq": 1}}, opts).Decode(&doc)
+	if err != nil {
+		log.Println("Room sequence error:", err)
+		return 0
+	}
+	return doc.Seq
+}
+
+// currentSeq returns the last sequence assigned in a room
+func currentSeq(ctx context.Context, roomID string) (int64, error) {
+	var doc struct {
+		Seq int64 `bson:"seq"`
+	}
+	err := config.DB.Collection("room_sequences").FindOne(ctx, bson.M{"_id": roomID}).Decode(&doc)
+	if err == mongo.ErrNoDocuments {
+		return 0, nil
+	}
+	return doc.Seq, err
+}
+
+// logEvent stores an encoded room event under its sequence
+func logEvent(roomID string, seq int64, eventType string, data json.RawMessage) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err := config.DB.Collection("room_events").InsertOne(ctx, roomEvent{
+		RoomID:    roomID,
+		Seq:       seq,
+		Type:      eventType,
+		Data:      data,
+		CreatedAt: time.Now(),
+	})
+	if err != nil {
+		log.Println("Event log error:", err)
+	}
+}
+
+// eventsAfter returns the logged events of a room with a sequence above after, in order
+// complete is false when the log no longer covers the whole gap or the gap exceeds Opts.ReplayMax
+func eventsAfter(ctx context.Context, roomID string, after, current int64) (events []roomEvent, complete bool, err error) {
+	if after > current {
+		// The client saw a sequence this room never reached, so its state cannot be trusted
+		return nil, false, nil
+	}
+	if current == after {
+		return nil, true, nil
+	}
+	if current-after > int64(Opts.ReplayMax) {
+		return nil, false, nil
+	}
+	opts := options.Find().SetSort(bson.M{"seq": 1})
+	cursor, err := config.DB.Collection("room_events").Find(ctx, bson.M{"roomId": roomID, "seq": bson.M{"$gt": after, "$lte": current}}, opts)
+	if err != nil {
+		return nil, false, err
+	}
+	if err := cursor.All(ctx, &events); err != nil {
+		return nil, false, err
+	}
+	if int64(len(events)) != current-after {
+		return nil, false, nil
+	}
+	return events, true, nil
+}
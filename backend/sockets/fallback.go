@@ -0,0 +1,256 @@
+package sockets
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"line/models"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Fallback transports for clients whose network blocks WebSocket upgrades
+// Server-Sent Events and long-polling receive the same hub frames as a socket, and frames the
+// client would have written to the socket are POSTed to HandleFallbackSend instead
+
+// fallbackSession tracks a client connected over SSE or long-poll
+// lastPoll is used to expire long-poll sessions whose client went away
+type fallbackSession struct {
+	client   *Client
+	lastPoll time.Time
+	polling  int
+}
+
+var (
+	fallbackMu       sync.Mutex
+	fallbackSessions = make(map[string]*fallbackSession)
+	reaperOnce       sync.Once
+)
+
+// maxPollWait caps how long a long-poll request is held open
+const maxPollWait = 30 * time.Second
+
+// fallbackUserID returns the ID of the user authenticated by the JWTAuth middleware
+func fallbackUserID(c *gin.Context) (string, bool) {
+	userI, exists := c.Get("user")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return "", false
+	}
+	return userI.(models.User).ID.Hex(), true
+}
+
+// openFallback creates and registers a client for a fallback transport
+func openFallback(c *gin.Context, transport, userID string) (*Client, bool) {
+	if Closing() {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Server is shutting down"})
+		return nil, false
+	}
+	version, err := negotiateVersion("", c.Query("v"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error(), "code": ErrUnsupportedVersion})
+		return nil, false
+	}
+	client := newClient(nil, transport, userID, c.Query("device"), version)
+	fallbackMu.Lock()
+	fallbackSessions[client.SessionID] = &fallbackSession{client: client, lastPoll: time.Now()}
+	fallbackMu.Unlock()
+	return client, true
+}
+
+// closeFallback forgets a fallback session and releases its client; later calls are no-ops
+func closeFallback(client *Client) {
+	fallbackMu.Lock()
+	_, ok := fallbackSessions[client.SessionID]
+	delete(fallbackSessions, client.SessionID)
+	fallbackMu.Unlock()
+	if ok {
+		client.release()
+	}
+}
+
+// lookupFallback returns the session with the given ID if it belongs to the user
+func lookupFallback(sessionID, userID string) *fallbackSession {
+	fallbackMu.Lock()
+	defer fallbackMu.Unlock()
+	session := fallbackSessions[sessionID]
+	if session == nil || session.client.UserID != userID {
+		return nil
+	}
+	return session
+}
+
+// HandleSSE streams hub frames to the client as Server-Sent Events until it disconnects
+// Each frame is sent as a "data:" line holding the same JSON a socket would receive
+func HandleSSE(c *gin.Context) {
+	userID, ok := fallbackUserID(c)
+	if !ok {
+		return
+	}
+	client, ok := openFallback(c, TransportSSE, userID)
+	if !ok {
+		return
+	}
+	defer closeFallback(client)
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+
+	ticker := time.NewTicker(Opts.PingPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.Request.Context().Done():
+			return
+		case <-client.done:
+			return
+		case msg := <-client.Send:
+			data, err := json.Marshal(msg)
+			if err != nil {
+				continue
+			}
+			if _, err := fmt.Fprintf(c.Writer, "data: %s\n\n", data); err != nil {
+				return
+			}
+			c.Writer.Flush()
+		case <-ticker.C:
+			// Comment lines keep proxies from closing an idle stream
+			if _, err := io.WriteString(c.Writer, ": ping\n\n"); err != nil {
+				return
+			}
+			c.Writer.Flush()
+		}
+	}
+}
+
+// HandlePoll serves one long-poll request
+// Without a session query parameter it opens a session and returns the hello frame at once;
+// with one it waits up to "wait" (default and maximum 30s) for frames and returns every queued frame
+func HandlePoll(c *gin.Context) {
+	userID, ok := fallbackUserID(c)
+	if !ok {
+		return
+	}
+	reaperOnce.Do(func() { go reapPollSessions() })
+
+	sessionID := c.Query("session")
+	if sessionID == "" {
+		client, ok := openFallback(c, TransportPoll, userID)
+		if !ok {
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"sessionId": client.SessionID, "events": drain(client, 0)})
+		return
+	}
+
+	// Mark the session as polling under the lock so the reaper cannot expire it mid-request
+	fallbackMu.Lock()
+	session := fallbackSessions[sessionID]
+	if session != nil && session.client.UserID == userID && session.client.Transport == TransportPoll {
+		session.polling++
+	} else {
+		session = nil
+	}
+	fallbackMu.Unlock()
+	if session == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Session expired", "code": ErrNotFound})
+		return
+	}
+
+	wait := maxPollWait
+	if d, err := time.ParseDuration(c.Query("wait")); err == nil && d >= 0 && d < maxPollWait {
+		wait = d
+	}
+	events := drain(session.client, wait)
+	fallbackMu.Lock()
+	session.polling--
+	session.lastPoll = time.Now()
+	fallbackMu.Unlock()
+
+	select {
+	case <-session.client.done:
+		// Evicted as a slow consumer; the client has to open a new session and resume
+		closeFallback(session.client)
+		c.JSON(http.StatusGone, gin.H{"error": "Session closed", "code": ErrNotFound, "events": events})
+	default:
+		c.JSON(http.StatusOK, gin.H{"sessionId": session.client.SessionID, "events": events})
+	}
+}
+
+// drain waits up to wait for a first frame, then returns it together with every other queued frame
+// A wait of zero only collects what is already queued, such as the hello frame of a new session; racing
+// an expired timer against the queue could return nothing
+func drain(client *Client, wait time.Duration) []interface{} {
+	events := []interface{}{}
+	if wait > 0 {
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		select {
+		case msg := <-client.Send:
+			events = append(events, msg)
+		case <-client.done:
+			return events
+		case <-timer.C:
+			return events
+		}
+	}
+	for {
+		select {
+		case msg := <-client.Send:
+			events = append(events, msg)
+		default:
+			return events
+		}
+	}
+}
+
+// reapPollSessions closes long-poll sessions that have not polled within the pong wait
+func reapPollSessions() {
+	ticker := time.NewTicker(Opts.PongWait / 2)
+	defer ticker.Stop()
+	for range ticker.C {
+		var expired []*Client
+		fallbackMu.Lock()
+		for _, session := range fallbackSessions {
+			if session.client.Transport == TransportPoll && session.polling == 0 && time.Since(session.lastPoll) > Opts.PongWait {
+				expired = append(expired, session.client)
+			}
+		}
+		fallbackMu.Unlock()
+		for _, client := range expired {
+			closeFallback(client)
+		}
+	}
+}
+
+// HandleFallbackSend accepts one protocol frame from an SSE or long-poll session
+// The frame is handled exactly like a socket frame; its ack or error arrives on the session's stream
+func HandleFallbackSend(c *gin.Context) {
+	userID, ok := fallbackUserID(c)
+	if !ok {
+		return
+	}
+	session := lookupFallback(c.Query("session"), userID)
+	if session == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Session expired", "code": ErrNotFound})
+		return
+	}
+	raw, err := io.ReadAll(io.LimitReader(c.Request.Body, Opts.MaxMessageSize+1))
+	if err != nil || int64(len(raw)) > Opts.MaxMessageSize {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "Frame too large", "code": ErrBadFrame})
+		return
+	}
+	if !beginWork() {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Server is shutting down"})
+		return
+	}
+	session.client.handleFrame(raw)
+	endWork()
+	c.JSON(http.StatusAccepted, gin.H{"message": "Accepted"})
+}
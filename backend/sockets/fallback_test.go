@@ -0,0 +1,37 @@
+package sockets
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDrainWithoutWait(t *testing.T) {
+	// The select used to race the queue against an expired timer, so repeat to catch a lost frame
+	for i := 0; i < 1000; i++ {
+		c := &Client{Send: make(chan interface{}, 2), done: make(chan struct{})}
+		c.Send <- "hello"
+		c.Send <- "event"
+		if got := drain(c, 0); len(got) != 2 || got[0] != "hello" {
+			t.Fatalf("drain(0) = %v, want the two queued frames", got)
+		}
+	}
+	c := &Client{Send: make(chan interface{}, 1), done: make(chan struct{})}
+	if got := drain(c, 0); len(got) != 0 {
+		t.Errorf("drain(0) on an empty queue = %v, want no frames", got)
+	}
+}
+
+func TestDrainWaitsForFirstFrame(t *testing.T) {
+	c := &Client{Send: make(chan interface{}, 1), done: make(chan struct{})}
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		c.Send <- "late"
+	}()
+	if got := drain(c, time.Second); len(got) != 1 || got[0] != "late" {
+		t.Errorf("drain(1s) = %v, want the late frame", got)
+	}
+	start := time.Now()
+	if got := drain(c, 20*time.Millisecond); len(got) != 0 || time.Since(start) < 20*time.Millisecond {
+		t.Errorf("drain(20ms) = %v after %s, want no frames after the wait", got, time.Since(start))
+	}
+}
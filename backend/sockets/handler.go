@@ -1,18 +1,26 @@
 package sockets
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"line/utils"
 	"net/http"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/gorilla/websocket"
 )
 
 var upgrader = websocket.Upgrader{
-	CheckOrigin: func(r *http.Request) bool { return true },
+	CheckOrigin:  func(r *http.Request) bool { return true },
+	Subprotocols: []string{Subprotocol},
 }
 
 func HandleWebSocket(c *gin.Context) {
+	if Closing() {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Server is shutting down"})
+		return
+	}
 	token := c.Query("token")
 	userID, err := utils.ParseJWT(token)
 	if err != nil {
@@ -23,19 +31,27 @@ func HandleWebSocket(c *gin.Context) {
 	if err != nil {
 		return
 	}
-	client := &Client{
-		Conn:   conn,
-		UserID: userID,
-		Send:   make(chan interface{}),
+	version, err := negotiateVersion(conn.Subprotocol(), c.Query("v"))
+	if err != nil {
+		msg := websocket.FormatCloseMessage(websocket.CloseProtocolError, err.Error())
+		conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(Opts.WriteWait))
+		conn.Close()
+		return
 	}
-	H.Clients[userID] = client
+	client := newClient(conn, TransportWebSocket, userID, c.Query("device"), version)
 	go client.WritePump()
 	client.ReadPump()
-	// Remove client from hub on disconnect
-	delete(H.Clients, userID)
-	if client.RoomID != "" {
-		H.mu.Lock()
-		delete(H.Rooms[client.RoomID], userID)
-		H.mu.Unlock()
-	}
+	client.release()
+}
+
+// newSessionID returns a random identifier for a connection
+func newSessionID() string {
+	b := make([]byte, 12)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// HandleStats reports connection counts and outbound frame counters
+func HandleStats(c *gin.Context) {
+	c.JSON(http.StatusOK, H.Stats())
 }
@@ -1,91 +1,298 @@
 package sockets
 
 import (
+	"context"
+	"encoding/json"
+	"line/metrics"
+	"log"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // Hub manages all WebSocket clients and rooms
+// Clients maps a user ID to every connection that user has open
+// Rooms maps a room ID to the connections subscribed to it
 type Hub struct {
-	Clients   map[string]*Client
-	Rooms     map[string]map[string]*Client
+	Clients   map[string]map[*Client]bool
+	Rooms     map[string]map[*Client]bool
 	Broadcast chan MessageEvent
+	Thread    chan ThreadEvent
 	Typing    chan TypingEvent
 	Presence  chan PresenceEvent
+	Mention   chan MentionEvent
 	Reaction  chan ReactionEvent
 	Pin       chan PinEvent
 	Star      chan StarEvent
 	Delete    chan DeleteEvent
 	Forward   chan ForwardEvent
+	Edit      chan EditEvent
+	Delivered chan DeliveredEvent
+	Read      chan ReadEvent
+	stop      chan struct{}
+	broker    Broker
+	typists   *typingTracker
 	mu        sync.Mutex
+	lanes     map[string]*lane
+	lanesMu   sync.Mutex
+	laneWork  sync.WaitGroup
+	sent      atomic.Uint64
+	dropped   atomic.Uint64
+	evicted   atomic.Uint64
 }
 
 var H = &Hub{
-	Clients:   make(map[string]*Client),
-	Rooms:     make(map[string]map[string]*Client),
+	Clients:   make(map[string]map[*Client]bool),
+	Rooms:     make(map[string]map[*Client]bool),
 	Broadcast: make(chan MessageEvent),
+	Thread:    make(chan ThreadEvent),
 	Typing:    make(chan TypingEvent),
 	Presence:  make(chan PresenceEvent),
+	Mention:   make(chan MentionEvent),
 	Reaction:  make(chan ReactionEvent),
 	Pin:       make(chan PinEvent),
 	Star:      make(chan StarEvent),
 	Delete:    make(chan DeleteEvent),
 	Forward:   make(chan ForwardEvent),
+	Edit:      make(chan EditEvent),
+	Delivered: make(chan DeliveredEvent),
+	Read:      make(chan ReadEvent),
+	stop:      make(chan struct{}),
+	broker:    NewLocalBroker(),
+	typists:   newTypingTracker(),
+	lanes:     make(map[string]*lane),
 }
 
-// Run starts the main event loop for the hub
+// UseBroker replaces the broker events are published through; it must be called before Run
+func (h *Hub) UseBroker(b Broker) {
+	h.broker = b
+}
+
+// Register adds a connection to the hub and reports whether it is the user's first
+func (h *Hub) Register(c *Client) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.Clients[c.UserID] == nil {
+		h.Clients[c.UserID] = make(map[*Client]bool)
+	}
+	h.Clients[c.UserID][c] = true
+	return len(h.Clients[c.UserID]) == 1
+}
+
+// Unregister removes a connection and its room subscriptions from the hub
+// It returns the rooms the connection was subscribed to and whether the user has no connections left
+func (h *Hub) Unregister(c *Client) ([]string, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	rooms := make([]string, 0, len(c.Rooms))
+	for roomID := range c.Rooms {
+		rooms = append(rooms, roomID)
+		h.leave(c, roomID)
+	}
+	conns := h.Clients[c.UserID]
+	delete(conns, c)
+	if len(conns) == 0 {
+		delete(h.Clients, c.UserID)
+		return rooms, true
+	}
+	return rooms, false
+}
+
+// IsOnline reports whether the user has at least one open connection
+func (h *Hub) IsOnline(userID string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.Clients[userID]) > 0
+}
+
+// SendToUser delivers an event to every connection of a user on every instance
+func (h *Hub) SendToUser(userID string, eventType string, msg interface{}) {
+	h.publish(BrokerMessage{Type: eventType, UserIDs: []string{userID}}, 0, msg)
+}
+
+// Join subscribes a client to the events of a room
+// It reports false, and joins nothing, once the client is closed or no longer registered
+func (h *Hub) Join(c *Client, roomID string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if c.closed() || !h.Clients[c.UserID][c] {
+		return false
+	}
+	if h.Rooms[roomID] == nil {
+		h.Rooms[roomID] = make(map[*Client]bool)
+	}
+	h.Rooms[roomID][c] = true
+	c.Rooms[roomID] = true
+	return true
+}
+
+// Leave unsubscribes a client from a room
+func (h *Hub) Leave(c *Client, roomID string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.leave(c, roomID)
+}
+
+// leave removes the client from a room; the caller must hold h.mu
+func (h *Hub) leave(c *Client, roomID string) {
+	if members, ok := h.Rooms[roomID]; ok && members[c] {
+		delete(members, c)
+		if len(members) == 0 {
+			delete(h.Rooms, roomID)
+		}
+	}
+	delete(c.Rooms, roomID)
+}
+
+// Run subscribes the hub to its broker and starts the main event loop
+// The loop only hands events to lanes: room events are stamped, logged and published in order on their
+// room's lane, and the other events on a lane of their own. It returns once Shutdown stops it
 func (h *Hub) Run() {
+	if err := h.broker.Subscribe(h.deliver); err != nil {
+		log.Fatal("Hub broker subscribe error:", err)
+	}
+	go h.expireTypists()
+	go h.keepPresence()
 	for {
 		select {
 		case msg := <-h.Broadcast:
-			h.mu.Lock()
-			for _, client := range h.Rooms[msg.RoomID] {
-				client.Send <- msg
-			}
-			h.mu.Unlock()
-		case typing := <-h.Typing:
-			h.mu.Lock()
-			for _, client := range h.Rooms[typing.RoomID] {
-				if client.UserID != typing.UserID {
-					client.Send <- typing
+			h.sequenced(msg.RoomID, msg.Type, func(seq int64) interface{} { msg.Seq = seq; return msg })
+		case thread := <-h.Thread:
+			h.dispatch(thread.RoomID, func() {
+				thread.Seq = nextSeq(thread.RoomID)
+				h.publish(BrokerMessage{Type: thread.Type, RoomID: thread.RoomID}, thread.Seq, thread)
+				if len(thread.Followers) > 0 {
+					thread.Type = "thread_notification"
+					h.publish(BrokerMessage{Type: thread.Type, UserIDs: thread.Followers}, 0, thread)
 				}
-			}
-			h.mu.Unlock()
+			})
+		case typing := <-h.Typing:
+			h.dispatch("typing:"+typing.RoomID, func() {
+				h.publish(BrokerMessage{Type: typingTopic, RoomID: typing.RoomID}, 0, typing)
+			})
 		case presence := <-h.Presence:
-			h.mu.Lock()
-			for _, client := range h.Rooms[presence.RoomID] {
-				client.Send <- presence
-			}
-			h.mu.Unlock()
+			h.dispatch("presence:"+presence.UserID, func() {
+				h.publish(BrokerMessage{Type: presence.Type, UserIDs: presence.To}, 0, presence)
+			})
+		case mention := <-h.Mention:
+			h.dispatch("mention:"+mention.RoomID, func() {
+				h.publish(BrokerMessage{Type: mention.Type, UserIDs: mention.To}, 0, mention)
+			})
 		case reaction := <-h.Reaction:
-			h.mu.Lock()
-			for _, client := range h.Rooms[reaction.RoomID] {
-				client.Send <- reaction
-			}
-			h.mu.Unlock()
+			h.sequenced(reaction.RoomID, reaction.Type, func(seq int64) interface{} { reaction.Seq = seq; return reaction })
 		case pin := <-h.Pin:
-			h.mu.Lock()
-			for _, client := range h.Rooms[pin.RoomID] {
-				client.Send <- pin
-			}
-			h.mu.Unlock()
+			h.sequenced(pin.RoomID, pin.Type, func(seq int64) interface{} { pin.Seq = seq; return pin })
 		case star := <-h.Star:
-			h.mu.Lock()
-			for _, client := range h.Rooms[star.RoomID] {
-				client.Send <- star
-			}
-			h.mu.Unlock()
+			h.sequenced(star.RoomID, star.Type, func(seq int64) interface{} { star.Seq = seq; return star })
 		case del := <-h.Delete:
-			h.mu.Lock()
-			for _, client := range h.Rooms[del.RoomID] {
-				client.Send <- del
-			}
-			h.mu.Unlock()
+			h.sequenced(del.RoomID, del.Type, func(seq int64) interface{} { del.Seq = seq; return del })
 		case fwd := <-h.Forward:
-			h.mu.Lock()
-			for _, client := range h.Rooms[fwd.RoomID] {
-				client.Send <- fwd
+			h.sequenced(fwd.RoomID, fwd.Type, func(seq int64) interface{} { fwd.Seq = seq; return fwd })
+		case edit := <-h.Edit:
+			h.sequenced(edit.RoomID, edit.Type, func(seq int64) interface{} { edit.Seq = seq; return edit })
+		case read := <-h.Read:
+			h.sequenced(read.RoomID, read.Type, func(seq int64) interface{} { read.Seq = seq; return read })
+		case delivered := <-h.Delivered:
+			h.dispatch("delivered:"+delivered.SenderID, func() {
+				h.publish(BrokerMessage{Type: delivered.Type, UserIDs: []string{delivered.SenderID}}, 0, delivered)
+			})
+		case <-h.stop:
+			return
+		}
+	}
+}
+
+// publish encodes an event once and hands it to the broker for delivery on every instance
+// Events stamped with a room sequence are also written to the event log for replay
+func (h *Hub) publish(msg BrokerMessage, seq int64, event interface{}) {
+	data, err := json.Marshal(event)
+	if err != nil {
+		log.Println("Hub encode error:", err)
+		return
+	}
+	if seq > 0 {
+		logEvent(msg.RoomID, seq, msg.Type, data)
+	}
+	metrics.HubPublished.WithLabelValues(msg.Type).Inc()
+	msg.Origin = NodeID
+	msg.Data = data
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := h.broker.Publish(ctx, msg); err != nil {
+		log.Println("Hub publish error:", err)
+	}
+}
+
+// deliver queues a broker message for the local connections it is addressed to
+// Queueing never blocks, so a stalled client cannot hold up the other rooms
+func (h *Hub) deliver(msg BrokerMessage) {
+	if msg.Type == membershipTopic {
+		// Reloading members queries MongoDB, so keep it off the broker's delivery path
+		go membership.invalidate(h, msg.RoomID)
+		return
+	}
+	if msg.Type == typingTopic {
+		h.applyTyping(msg)
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	frames := 0
+	if msg.RoomID != "" {
+		for client := range h.Rooms[msg.RoomID] {
+			if msg.SkipUser != "" && client.UserID == msg.SkipUser {
+				continue
 			}
-			h.mu.Unlock()
+			client.enqueue(msg.Data)
+			frames++
+		}
+	}
+	for _, userID := range msg.UserIDs {
+		for client := range h.Clients[userID] {
+			client.enqueue(msg.Data)
+			frames++
+		}
+	}
+	metrics.HubFanout.WithLabelValues(msg.Type).Add(float64(frames))
+}
+
+// deliverLocal encodes an event and queues it for the local subscribers of a room
+func (h *Hub) deliverLocal(eventType, roomID, skipUser string, event interface{}) {
+	data, err := json.Marshal(event)
+	if err != nil {
+		log.Println("Hub encode error:", err)
+		return
+	}
+	h.deliver(BrokerMessage{Type: eventType, RoomID: roomID, SkipUser: skipUser, Data: data})
+}
+
+// HubStats is a snapshot of the hub's counters
+type HubStats struct {
+	Users       int    `json:"users"`
+	Connections int    `json:"connections"`
+	Rooms       int    `json:"rooms"`
+	QueuedNow   int    `json:"queuedNow"`
+	Sent        uint64 `json:"sent"`
+	Dropped     uint64 `json:"dropped"`
+	Evicted     uint64 `json:"evicted"`
+}
+
+// Stats returns the current connection counts and frame counters
+func (h *Hub) Stats() HubStats {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	stats := HubStats{
+		Users:   len(h.Clients),
+		Rooms:   len(h.Rooms),
+		Sent:    h.sent.Load(),
+		Dropped: h.dropped.Load(),
+		Evicted: h.evicted.Load(),
+	}
+	for _, conns := range h.Clients {
+		for client := range conns {
+			stats.Connections++
+			stats.QueuedNow += len(client.Send)
 		}
 	}
+	return stats
 }
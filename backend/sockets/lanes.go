@@ -0,0 +1,50 @@
+package sockets
+
+// lane runs publish jobs for one key in order on its own goroutine
+// Lanes are created on demand and exit once their queue is empty
+type lane struct {
+	jobs []func()
+}
+
+// dispatch queues a job on the lane for key, starting the lane if it is idle
+// Jobs with the same key run one after another in the order they were queued; different keys run
+// concurrently. The hub loop only queues, so a slow MongoDB write holds up a single room, not all of them
+func (h *Hub) dispatch(key string, job func()) {
+	h.lanesMu.Lock()
+	defer h.lanesMu.Unlock()
+	l, running := h.lanes[key]
+	if !running {
+		l = &lane{}
+		h.lanes[key] = l
+		h.laneWork.Add(1)
+		go h.runLane(key, l)
+	}
+	l.jobs = append(l.jobs, job)
+}
+
+// runLane works through a lane's queue and removes the lane once it is drained
+func (h *Hub) runLane(key string, l *lane) {
+	defer h.laneWork.Done()
+	for {
+		h.lanesMu.Lock()
+		if len(l.jobs) == 0 {
+			delete(h.lanes, key)
+			h.lanesMu.Unlock()
+			return
+		}
+		job := l.jobs[0]
+		l.jobs[0] = nil
+		l.jobs = l.jobs[1:]
+		h.lanesMu.Unlock()
+		job()
+	}
+}
+
+// sequenced stamps a room event with the room's next seq and publishes it on the room's lane
+// stamp sets the seq on the event and returns it; events of a room are stamped and published in order
+func (h *Hub) sequenced(roomID, eventType string, stamp func(seq int64) interface{}) {
+	h.dispatch(roomID, func() {
+		seq := nextSeq(roomID)
+		h.publish(BrokerMessage{Type: eventType, RoomID: roomID}, seq, stamp(seq))
+	})
+}
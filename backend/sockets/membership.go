@@ -0,0 +1,102 @@
+package sockets
+
+import (
+	"context"
+	"line/config"
+	"line/models"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// membershipTopic is the broker message type used to invalidate cached membership on every instance
+const membershipTopic = "_membership"
+
+// roomMembers is a cached member list of a room
+type roomMembers struct {
+	members map[string]bool
+	expires time.Time
+}
+
+// membershipCache keeps room member lists so every inbound event can be checked without a query
+// Entries are dropped by InvalidateMembership when a room's members change and expire after
+// Opts.MembershipTTL as a safety net
+type membershipCache struct {
+	mu    sync.RWMutex
+	rooms map[string]roomMembers
+}
+
+var membership = &membershipCache{rooms: make(map[string]roomMembers)}
+
+// IsMember reports whether the user is listed in the room's members, using the cache when possible
+func IsMember(roomID, userID string) (bool, error) {
+	membership.mu.RLock()
+	entry, ok := membership.rooms[roomID]
+	membership.mu.RUnlock()
+	if ok && time.Now().Before(entry.expires) {
+		return entry.members[userID], nil
+	}
+
+	rid, err := primitive.ObjectIDFromHex(roomID)
+	if err != nil {
+		return false, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var room models.Room
+	opts := options.FindOne().SetProjection(bson.M{"members": 1})
+	err = config.DB.Collection("rooms").FindOne(ctx, bson.M{"_id": rid}, opts).Decode(&room)
+	if err == mongo.ErrNoDocuments {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	entry = roomMembers{members: make(map[string]bool, len(room.Members)), expires: time.Now().Add(Opts.MembershipTTL)}
+	for _, id := range room.Members {
+		entry.members[id.Hex()] = true
+	}
+	membership.mu.Lock()
+	membership.rooms[roomID] = entry
+	membership.mu.Unlock()
+	return entry.members[userID], nil
+}
+
+// InvalidateMembership drops the cached members of a room on every instance
+// Connections of users who are no longer members are unsubscribed from the room
+func (h *Hub) InvalidateMembership(roomID string) {
+	h.publish(BrokerMessage{Type: membershipTopic, RoomID: roomID}, 0, nil)
+}
+
+// invalidate forgets a room's cached members and unsubscribes local connections that lost access
+func (m *membershipCache) invalidate(h *Hub, roomID string) {
+	m.mu.Lock()
+	delete(m.rooms, roomID)
+	m.mu.Unlock()
+
+	h.mu.Lock()
+	var clients []*Client
+	for client := range h.Rooms[roomID] {
+		clients = append(clients, client)
+	}
+	h.mu.Unlock()
+	for _, client := range clients {
+		if ok, err := IsMember(roomID, client.UserID); err != nil || ok {
+			continue
+		}
+		// The lookup is slow, so the client may have left or been released meanwhile
+		h.mu.Lock()
+		subscribed := !client.closed() && h.Rooms[roomID][client]
+		if subscribed {
+			h.leave(client, roomID)
+		}
+		h.mu.Unlock()
+		if subscribed {
+			client.enqueue(ErrorEvent{Type: "error", Action: "leave", Code: ErrNotMember, Message: "No longer a member of this room", RoomID: roomID})
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package sockets
+
+import (
+	"line/metrics"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// hubCollector exports the hub's live state to Prometheus on every scrape
+// Connection counts and queue depths are read under the hub lock; frame counters come from the hub's atomics
+type hubCollector struct {
+	hub *Hub
+}
+
+var (
+	connectionsDesc = prometheus.NewDesc(prometheus.BuildFQName(metrics.Namespace, "ws", "connections"),
+		"Open real-time connections by transport.", []string{"transport"}, nil)
+	usersDesc = prometheus.NewDesc(prometheus.BuildFQName(metrics.Namespace, "ws", "users"),
+		"Users with at least one open connection.", nil, nil)
+	roomsDesc = prometheus.NewDesc(prometheus.BuildFQName(metrics.Namespace, "ws", "rooms"),
+		"Rooms with at least one subscribed connection.", nil, nil)
+	queuedDesc = prometheus.NewDesc(prometheus.BuildFQName(metrics.Namespace, "ws", "queued_frames"),
+		"Frames waiting in connection send queues.", nil, nil)
+	queueMaxDesc = prometheus.NewDesc(prometheus.BuildFQName(metrics.Namespace, "ws", "queue_depth_max"),
+		"Deepest connection send queue.", nil, nil)
+	sentDesc = prometheus.NewDesc(prometheus.BuildFQName(metrics.Namespace, "ws", "frames_sent_total"),
+		"Frames queued to connections.", nil, nil)
+	droppedDesc = prometheus.NewDesc(prometheus.BuildFQName(metrics.Namespace, "ws", "frames_dropped_total"),
+		"Frames dropped because a send queue was full.", nil, nil)
+	evictedDesc = prometheus.NewDesc(prometheus.BuildFQName(metrics.Namespace, "ws", "evictions_total"),
+		"Connections closed as slow consumers.", nil, nil)
+)
+
+func init() {
+	prometheus.MustRegister(hubCollector{hub: H})
+}
+
+func (hubCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, desc := range []*prometheus.Desc{connectionsDesc, usersDesc, roomsDesc, queuedDesc, queueMaxDesc, sentDesc, droppedDesc, evictedDesc} {
+		ch <- desc
+	}
+}
+
+func (hc hubCollector) Collect(ch chan<- prometheus.Metric) {
+	h := hc.hub
+	byTransport := map[string]int{TransportWebSocket: 0, TransportSSE: 0, TransportPoll: 0}
+	queued, deepest := 0, 0
+	h.mu.Lock()
+	users, rooms := len(h.Clients), len(h.Rooms)
+	for _, conns := range h.Clients {
+		for client := range conns {
+			byTransport[client.Transport]++
+			depth := len(client.Send)
+			queued += depth
+			if depth > deepest {
+				deepest = depth
+			}
+		}
+	}
+	h.mu.Unlock()
+
+	for transport, n := range byTransport {
+		ch <- prometheus.MustNewConstMetric(connectionsDesc, prometheus.GaugeValue, float64(n), transport)
+	}
+	ch <- prometheus.MustNewConstMetric(usersDesc, prometheus.GaugeValue, float64(users))
+	ch <- prometheus.MustNewConstMetric(roomsDesc, prometheus.GaugeValue, float64(rooms))
+	ch <- prometheus.MustNewConstMetric(queuedDesc, prometheus.GaugeValue, float64(queued))
+	ch <- prometheus.MustNewConstMetric(queueMaxDesc, prometheus.GaugeValue, float64(deepest))
+	ch <- prometheus.MustNewConstMetric(sentDesc, prometheus.CounterValue, float64(h.sent.Load()))
+	ch <- prometheus.MustNewConstMetric(droppedDesc, prometheus.CounterValue, float64(h.dropped.Load()))
+	ch <- prometheus.MustNewConstMetric(evictedDesc, prometheus.CounterValue, float64(h.evicted.Load()))
+}
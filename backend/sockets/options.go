@@ -0,0 +1,111 @@
+package sockets
+
+import (
+	"line/config"
+	"log"
+	"time"
+)
+
+// Slow consumer policies applied when a client's outbound queue is full
+const (
+	PolicyDrop       = "drop"
+	PolicyDisconnect = "disconnect"
+)
+
+// Close codes sent to clients in the close frame, beyond the standard ones
+// 4000 means the server saw no traffic within the pong wait and the client should reconnect
+// 4001 means the client fell too far behind and should reconnect and resync
+const (
+	CloseIdleTimeout  = 4000
+	CloseSlowConsumer = 4001
+)
+
+// minPresenceTTL is the shortest PRESENCE_TTL accepted
+const minPresenceTTL = 3 * time.Second
+
+// Options holds the tunables of the socket layer
+// SendQueueSize is the number of outbound frames buffered per connection
+// SlowConsumer decides what happens when that buffer is full: drop the frame or disconnect the client
+// WriteWait is the time allowed to write a single frame to the peer
+// PongWait is how long a connection may stay silent before it is considered dead; it must be at least 1s
+// PingPeriod is how often the server pings the peer and must be shorter than PongWait
+// MaxMessageSize is the largest inbound frame in bytes; bigger frames close the connection
+// EventLogTTL is how long room events are kept for replay after a reconnect
+// ReplayMax is the largest gap replayed on resume; bigger gaps ask the client to resync
+// MembershipTTL is how long a room's member list is cached before it is reloaded
+// RateLimitStrikes is how many throttled frames within RateLimitWindow get a client disconnected
+// TypingTTL is how long a typing_start lasts without being refreshed
+// PresenceTTL is how long a session stays in the presence collection after its instance stops refreshing it; it must be at least 3s
+// PresenceAwayAfter is how long a session may go without heartbeats or other frames before it counts as away
+type Options struct {
+	SendQueueSize  int
+	SlowConsumer   string
+	WriteWait      time.Duration
+	PongWait       time.Duration
+	PingPeriod     time.Duration
+	MaxMessageSize int64
+	EventLogTTL    time.Duration
+	ReplayMax      int
+	MembershipTTL  time.Duration
+
+	RateLimitStrikes int
+	RateLimitWindow  time.Duration
+	TypingTTL        time.Duration
+
+	PresenceTTL       time.Duration
+	PresenceAwayAfter time.Duration
+}
+
+// Opts are the options in effect, replaced by LoadOptions at startup
+var Opts = Options{
+	SendQueueSize:  256,
+	SlowConsumer:   PolicyDisconnect,
+	WriteWait:      10 * time.Second,
+	PongWait:       60 * time.Second,
+	PingPeriod:     54 * time.Second,
+	MaxMessageSize: 64 * 1024,
+	EventLogTTL:    72 * time.Hour,
+	ReplayMax:      100,
+	MembershipTTL:  5 * time.Minute,
+
+	RateLimitStrikes: 20,
+	RateLimitWindow:  time.Minute,
+	TypingTTL:        6 * time.Second,
+
+	PresenceTTL:       90 * time.Second,
+	PresenceAwayAfter: 5 * time.Minute,
+}
+
+// LoadOptions reads the socket options from the environment
+func LoadOptions() {
+	Opts.SendQueueSize = config.GetEnvInt("WS_SEND_QUEUE", Opts.SendQueueSize)
+	Opts.WriteWait = config.GetEnvDuration("WS_WRITE_WAIT", Opts.WriteWait)
+	if policy := config.GetEnv("WS_SLOW_CONSUMER", Opts.SlowConsumer); policy == PolicyDrop || policy == PolicyDisconnect {
+		Opts.SlowConsumer = policy
+	}
+	if pongWait := config.GetEnvDuration("WS_PONG_WAIT", Opts.PongWait); pongWait >= time.Second {
+		Opts.PongWait = pongWait
+	} else {
+		log.Printf("WS_PONG_WAIT must be at least 1s, using %s", Opts.PongWait)
+	}
+	Opts.PingPeriod = config.GetEnvDuration("WS_PING_PERIOD", Opts.PongWait*9/10)
+	if Opts.PingPeriod <= 0 || Opts.PingPeriod >= Opts.PongWait {
+		log.Printf("WS_PING_PERIOD must be positive and shorter than WS_PONG_WAIT, using %s", Opts.PongWait*9/10)
+		Opts.PingPeriod = Opts.PongWait * 9 / 10
+	}
+	Opts.MaxMessageSize = int64(config.GetEnvInt("WS_MAX_MESSAGE_SIZE", int(Opts.MaxMessageSize)))
+	Opts.EventLogTTL = config.GetEnvDuration("EVENT_LOG_TTL", Opts.EventLogTTL)
+	Opts.ReplayMax = config.GetEnvInt("WS_REPLAY_MAX", Opts.ReplayMax)
+	Opts.MembershipTTL = config.GetEnvDuration("MEMBERSHIP_CACHE_TTL", Opts.MembershipTTL)
+	Opts.RateLimitStrikes = config.GetEnvInt("WS_RATE_STRIKES", Opts.RateLimitStrikes)
+	Opts.RateLimitWindow = config.GetEnvDuration("WS_RATE_STRIKE_WINDOW", Opts.RateLimitWindow)
+	Opts.TypingTTL = config.GetEnvDuration("WS_TYPING_TTL", Opts.TypingTTL)
+	// keepPresence refreshes sessions every third of the TTL, so it needs a usable ticker period
+	if ttl := config.GetEnvDuration("PRESENCE_TTL", Opts.PresenceTTL); ttl >= minPresenceTTL {
+		Opts.PresenceTTL = ttl
+	} else {
+		log.Printf("PRESENCE_TTL must be at least %s, using %s", minPresenceTTL, Opts.PresenceTTL)
+	}
+	Opts.PresenceAwayAfter = config.GetEnvDuration("PRESENCE_AWAY_AFTER", Opts.PresenceAwayAfter)
+	LoadRateLimits()
+}
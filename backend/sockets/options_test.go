@@ -0,0 +1,68 @@
+package sockets
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLoadOptionsHeartbeats(t *testing.T) {
+	tests := []struct {
+		name           string
+		pongWait       string
+		pingPeriod     string
+		wantPongWait   time.Duration
+		wantPingPeriod time.Duration
+	}{
+		{name: "defaults", wantPongWait: 60 * time.Second, wantPingPeriod: 54 * time.Second},
+		{name: "valid values", pongWait: "30s", pingPeriod: "10s", wantPongWait: 30 * time.Second, wantPingPeriod: 10 * time.Second},
+		{name: "ping period defaults from the pong wait", pongWait: "10s", wantPongWait: 10 * time.Second, wantPingPeriod: 9 * time.Second},
+		{name: "ping period not shorter than the pong wait", pongWait: "10s", pingPeriod: "10s", wantPongWait: 10 * time.Second, wantPingPeriod: 9 * time.Second},
+		{name: "zero durations", pongWait: "0s", pingPeriod: "0s", wantPongWait: 60 * time.Second, wantPingPeriod: 54 * time.Second},
+		{name: "pong wait too short", pongWait: "1ms", wantPongWait: 60 * time.Second, wantPingPeriod: 54 * time.Second},
+		{name: "unparsable", pongWait: "soon", wantPongWait: 60 * time.Second, wantPingPeriod: 54 * time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			saved := Opts
+			defer func() { Opts = saved }()
+			// An empty value is ignored like an invalid one, which leaves the default in place
+			t.Setenv("WS_PONG_WAIT", tt.pongWait)
+			t.Setenv("WS_PING_PERIOD", tt.pingPeriod)
+
+			LoadOptions()
+			if Opts.PongWait != tt.wantPongWait {
+				t.Errorf("PongWait = %s, want %s", Opts.PongWait, tt.wantPongWait)
+			}
+			if Opts.PingPeriod != tt.wantPingPeriod {
+				t.Errorf("PingPeriod = %s, want %s", Opts.PingPeriod, tt.wantPingPeriod)
+			}
+		})
+	}
+}
+
+func TestLoadOptionsPresenceTTL(t *testing.T) {
+	tests := []struct {
+		value string
+		want  time.Duration
+	}{
+		{value: "", want: 90 * time.Second},
+		{value: "3s", want: 3 * time.Second},
+		{value: "2m", want: 2 * time.Minute},
+		{value: "0s", want: 90 * time.Second},
+		{value: "2ns", want: 90 * time.Second},
+		{value: "2s", want: 90 * time.Second},
+		{value: "90", want: 90 * time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			saved := Opts
+			defer func() { Opts = saved }()
+			t.Setenv("PRESENCE_TTL", tt.value)
+
+			LoadOptions()
+			if Opts.PresenceTTL != tt.want {
+				t.Errorf("PresenceTTL = %s, want %s", Opts.PresenceTTL, tt.want)
+			}
+		})
+	}
+}
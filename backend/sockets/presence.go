@@ -0,0 +1,387 @@
+package sockets
+
+import (
+	"context"
+	"line/config"
+	"log"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Presence statuses of a session and of a user
+// A user is online if any session is online, away if all sessions are away and offline without sessions
+const (
+	StatusOnline  = "online"
+	StatusAway    = "away"
+	StatusOffline = "offline"
+)
+
+// presenceSession is a connection's entry in the presence collection
+// Each instance keeps the entries of its own connections alive, so entries left by an instance
+// that died expire after Opts.PresenceTTL and are swept by whichever instance finds them first
+type presenceSession struct {
+	SessionID string    `bson:"_id"`
+	UserID    string    `bson:"userId"`
+	Node      string    `bson:"node"`
+	Status    string    `bson:"status"`
+	ExpiresAt time.Time `bson:"expiresAt"`
+}
+
+// PresenceInfo is the current presence of a user as returned by LookupPresence
+type PresenceInfo struct {
+	UserID   string     `json:"userId"`
+	Status   string     `json:"status"`
+	LastSeen *time.Time `json:"lastSeen,omitempty"`
+}
+
+func presenceCollection() *mongo.Collection {
+	return config.DB.Collection("presence")
+}
+
+// EnsurePresence creates the indexes of the presence collection
+// MongoDB removes expired entries on its own as a backstop to the sweep in keepPresence
+func EnsurePresence() {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	_, err := presenceCollection().Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.M{"userId": 1}},
+		{
+			Keys:    bson.M{"expiresAt": 1},
+			Options: options.Index().SetExpireAfterSeconds(0),
+		},
+	})
+	if err != nil {
+		log.Println("Could not create indexes for presence:", err)
+	}
+}
+
+// touch records activity on the session, clearing an away reported by the client
+// It reports whether the session's status changed and needs to be stored
+func (c *Client) touch(away bool) bool {
+	c.presenceMu.Lock()
+	defer c.presenceMu.Unlock()
+	c.lastActive = time.Now()
+	c.away = away
+	return c.sessionStatus(c.lastActive) != c.storedStatus
+}
+
+// sessionStatus is away when the client said so or has been inactive for Opts.PresenceAwayAfter
+// The caller must hold c.presenceMu
+func (c *Client) sessionStatus(now time.Time) string {
+	if c.away || now.Sub(c.lastActive) > Opts.PresenceAwayAfter {
+		return StatusAway
+	}
+	return StatusOnline
+}
+
+// markActive records activity from an inbound frame and stores the status if it went back to online
+func (c *Client) markActive() {
+	if !c.touch(false) {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := c.syncPresence(ctx); err != nil {
+		log.Println("Presence update error:", err)
+	}
+}
+
+// connectPresence stores a new session and announces the user if they just came online
+func (c *Client) connectPresence() {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c.presenceMu.Lock()
+	c.lastActive = time.Now()
+	c.storedStatus = StatusOnline
+	c.presenceMu.Unlock()
+	_, err := presenceCollection().InsertOne(ctx, presenceSession{
+		SessionID: c.SessionID,
+		UserID:    c.UserID,
+		Node:      NodeID,
+		Status:    StatusOnline,
+		ExpiresAt: time.Now().Add(Opts.PresenceTTL),
+	})
+	if err != nil {
+		log.Println("Presence connect error:", err)
+		return
+	}
+	updateUserPresence(ctx, c.UserID)
+}
+
+// disconnectPresence removes a closed session and announces the user if it was their last
+func (c *Client) disconnectPresence() {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := presenceCollection().DeleteOne(ctx, bson.M{"_id": c.SessionID}); err != nil {
+		log.Println("Presence disconnect error:", err)
+		return
+	}
+	updateUserPresence(ctx, c.UserID)
+}
+
+// syncPresence stores the session's status if it changed and updates the user's presence
+func (c *Client) syncPresence(ctx context.Context) error {
+	c.presenceMu.Lock()
+	status := c.sessionStatus(time.Now())
+	changed := status != c.storedStatus
+	c.storedStatus = status
+	c.presenceMu.Unlock()
+	if !changed {
+		return nil
+	}
+	_, err := presenceCollection().UpdateOne(ctx, bson.M{"_id": c.SessionID}, bson.M{"$set": bson.M{
+		"status":    status,
+		"expiresAt": time.Now().Add(Opts.PresenceTTL),
+	}})
+	if err != nil {
+		return err
+	}
+	updateUserPresence(ctx, c.UserID)
+	return nil
+}
+
+// updateUserPresence recomputes a user's presence from their sessions on every instance
+// The status and lastSeen are stored on the user, and a change is pushed to their contacts and to
+// everyone sharing a room with them. The conditional update makes sure only one instance pushes it
+func updateUserPresence(ctx context.Context, userID string) {
+	uid, err := primitive.ObjectIDFromHex(userID)
+	if err != nil {
+		return
+	}
+	statuses, err := sessionStatuses(ctx, []string{userID})
+	if err != nil {
+		log.Println("Presence lookup error:", err)
+		return
+	}
+	status := statusOf(statuses[userID])
+	now := time.Now()
+	res, err := config.DB.Collection("users").UpdateOne(ctx,
+		bson.M{"_id": uid, "presence": bson.M{"$ne": status}},
+		bson.M{"$set": bson.M{"presence": status, "lastSeen": now}})
+	if err != nil {
+		log.Println("Presence store error:", err)
+		return
+	}
+	if res.ModifiedCount == 0 {
+		return
+	}
+	audience, err := presenceAudience(ctx, uid)
+	if err != nil {
+		log.Println("Presence audience error:", err)
+		return
+	}
+	if len(audience) > 0 {
+		H.Presence <- PresenceEvent{Type: "presence", UserID: userID, Status: status, LastSeen: &now, To: audience}
+	}
+}
+
+// sessionStatuses returns the statuses of the live sessions of each user
+func sessionStatuses(ctx context.Context, userIDs []string) (map[string][]string, error) {
+	filter := bson.M{"userId": bson.M{"$in": userIDs}, "expiresAt": bson.M{"$gt": time.Now()}}
+	cursor, err := presenceCollection().Find(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+	var sessions []presenceSession
+	if err := cursor.All(ctx, &sessions); err != nil {
+		return nil, err
+	}
+	statuses := make(map[string][]string)
+	for _, s := range sessions {
+		statuses[s.UserID] = append(statuses[s.UserID], s.Status)
+	}
+	return statuses, nil
+}
+
+// statusOf folds session statuses into a user status
+func statusOf(sessions []string) string {
+	if len(sessions) == 0 {
+		return StatusOffline
+	}
+	for _, status := range sessions {
+		if status == StatusOnline {
+			return StatusOnline
+		}
+	}
+	return StatusAway
+}
+
+// presenceAudience returns the users who see a user's presence: whoever has them as a contact
+// and whoever shares a room with them
+func presenceAudience(ctx context.Context, uid primitive.ObjectID) ([]string, error) {
+	seen := map[string]bool{uid.Hex(): true}
+	audience := []string{}
+	add := func(id primitive.ObjectID) {
+		if !seen[id.Hex()] {
+			seen[id.Hex()] = true
+			audience = append(audience, id.Hex())
+		}
+	}
+
+	cursor, err := config.DB.Collection("users").Find(ctx, bson.M{"contacts": uid}, options.Find().SetProjection(bson.M{"_id": 1}))
+	if err != nil {
+		return nil, err
+	}
+	var contacts []struct {
+		ID primitive.ObjectID `bson:"_id"`
+	}
+	if err := cursor.All(ctx, &contacts); err != nil {
+		return nil, err
+	}
+	for _, u := range contacts {
+		add(u.ID)
+	}
+
+	members, err := coMembers(ctx, uid)
+	if err != nil {
+		return nil, err
+	}
+	for _, member := range members {
+		add(member)
+	}
+	return audience, nil
+}
+
+// presenceVisible returns the users whose presence a user may see: the user, their contacts and
+// everyone sharing a room with them, which is presenceAudience seen from the other side
+func presenceVisible(ctx context.Context, uid primitive.ObjectID) (map[string]bool, error) {
+	visible := map[string]bool{uid.Hex(): true}
+	var viewer struct {
+		Contacts []primitive.ObjectID `bson:"contacts"`
+	}
+	err := config.DB.Collection("users").FindOne(ctx, bson.M{"_id": uid}, options.FindOne().SetProjection(bson.M{"contacts": 1})).Decode(&viewer)
+	if err != nil && err != mongo.ErrNoDocuments {
+		return nil, err
+	}
+	for _, id := range viewer.Contacts {
+		visible[id.Hex()] = true
+	}
+	members, err := coMembers(ctx, uid)
+	if err != nil {
+		return nil, err
+	}
+	for _, member := range members {
+		visible[member.Hex()] = true
+	}
+	return visible, nil
+}
+
+// coMembers returns the members of every room the user belongs to, the user included
+func coMembers(ctx context.Context, uid primitive.ObjectID) ([]primitive.ObjectID, error) {
+	cursor, err := config.DB.Collection("rooms").Find(ctx, bson.M{"members": uid}, options.Find().SetProjection(bson.M{"members": 1}))
+	if err != nil {
+		return nil, err
+	}
+	var rooms []struct {
+		Members []primitive.ObjectID `bson:"members"`
+	}
+	if err := cursor.All(ctx, &rooms); err != nil {
+		return nil, err
+	}
+	var members []primitive.ObjectID
+	for _, room := range rooms {
+		members = append(members, room.Members...)
+	}
+	return members, nil
+}
+
+// LookupPresence returns the current presence and last-seen time of each user the viewer may see
+// Users outside the viewer's contacts and rooms are left out, as are invalid IDs
+func LookupPresence(ctx context.Context, viewerID string, requested []string) ([]PresenceInfo, error) {
+	vid, err := primitive.ObjectIDFromHex(viewerID)
+	if err != nil {
+		return nil, err
+	}
+	visible, err := presenceVisible(ctx, vid)
+	if err != nil {
+		return nil, err
+	}
+	userIDs := []string{}
+	for _, id := range requested {
+		if visible[id] {
+			userIDs = append(userIDs, id)
+		}
+	}
+	if len(userIDs) == 0 {
+		return []PresenceInfo{}, nil
+	}
+	statuses, err := sessionStatuses(ctx, userIDs)
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]primitive.ObjectID, 0, len(userIDs))
+	for _, id := range userIDs {
+		oid, _ := primitive.ObjectIDFromHex(id)
+		ids = append(ids, oid)
+	}
+	cursor, err := config.DB.Collection("users").Find(ctx, bson.M{"_id": bson.M{"$in": ids}}, options.Find().SetProjection(bson.M{"lastSeen": 1}))
+	if err != nil {
+		return nil, err
+	}
+	var users []struct {
+		ID       primitive.ObjectID `bson:"_id"`
+		LastSeen *time.Time         `bson:"lastSeen"`
+	}
+	if err := cursor.All(ctx, &users); err != nil {
+		return nil, err
+	}
+	lastSeen := make(map[string]*time.Time, len(users))
+	for _, u := range users {
+		lastSeen[u.ID.Hex()] = u.LastSeen
+	}
+
+	result := make([]PresenceInfo, 0, len(userIDs))
+	for _, id := range userIDs {
+		info := PresenceInfo{UserID: id, Status: statusOf(statuses[id]), LastSeen: lastSeen[id]}
+		result = append(result, info)
+	}
+	return result, nil
+}
+
+// keepPresence keeps this instance's sessions alive, marks idle ones away and sweeps sessions
+// left behind by instances that stopped without cleaning up
+func (h *Hub) keepPresence() {
+	ticker := time.NewTicker(Opts.PresenceTTL / 3)
+	defer ticker.Stop()
+	for range ticker.C {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		clients := h.connections()
+		ids := make([]string, 0, len(clients))
+		for _, c := range clients {
+			ids = append(ids, c.SessionID)
+		}
+		if len(ids) > 0 {
+			_, err := presenceCollection().UpdateMany(ctx, bson.M{"_id": bson.M{"$in": ids}},
+				bson.M{"$set": bson.M{"expiresAt": time.Now().Add(Opts.PresenceTTL)}})
+			if err != nil {
+				log.Println("Presence keepalive error:", err)
+			}
+		}
+		for _, c := range clients {
+			if err := c.syncPresence(ctx); err != nil {
+				log.Println("Presence update error:", err)
+			}
+		}
+		sweepPresence(ctx)
+		cancel()
+	}
+}
+
+// sweepPresence removes expired sessions one at a time so each is handled by a single instance
+func sweepPresence(ctx context.Context) {
+	for i := 0; i < 100; i++ {
+		var session presenceSession
+		err := presenceCollection().FindOneAndDelete(ctx, bson.M{"expiresAt": bson.M{"$lte": time.Now()}}).Decode(&session)
+		if err != nil {
+			if err != mongo.ErrNoDocuments {
+				log.Println("Presence sweep error:", err)
+			}
+			return
+		}
+		updateUserPresence(ctx, session.UserID)
+	}
+}
@@ -0,0 +1,24 @@
+package sockets
+
+import "testing"
+
+func TestStatusOf(t *testing.T) {
+	tests := []struct {
+		name     string
+		sessions []string
+		want     string
+	}{
+		{name: "no sessions", sessions: nil, want: StatusOffline},
+		{name: "one online", sessions: []string{StatusOnline}, want: StatusOnline},
+		{name: "one away", sessions: []string{StatusAway}, want: StatusAway},
+		{name: "any online wins", sessions: []string{StatusAway, StatusOnline, StatusAway}, want: StatusOnline},
+		{name: "all away", sessions: []string{StatusAway, StatusAway}, want: StatusAway},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := statusOf(tt.sessions); got != tt.want {
+				t.Errorf("statusOf(%v) = %q, want %q", tt.sessions, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,205 @@
+package sockets
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+)
+
+// Protocol versions understood by the server
+// Version 0 is the legacy flat frame ({"type": "message", "roomId": ...}) sent by older clients
+// Version 1 wraps the request fields in an envelope ({"type": "message", "id": "1", "v": 1, "payload": {...}})
+const (
+	ProtocolLegacy = 0
+	ProtocolV1     = 1
+	ProtocolLatest = ProtocolV1
+)
+
+// Subprotocol is offered in Sec-WebSocket-Protocol by clients that speak version 1
+const Subprotocol = "line.v1"
+
+// Error codes carried by ErrorEvent
+// Message actions can also fail with the service's policy codes: not_sender, not_sender_or_admin, window_closed, conflict
+const (
+	ErrBadFrame           = "bad_frame"
+	ErrBadRequest         = "bad_request"
+	ErrUnknownType        = "unknown_type"
+	ErrUnsupportedVersion = "unsupported_version"
+	ErrForbidden          = "forbidden"
+	ErrNotMember          = "not_member"
+	ErrNotFound           = "not_found"
+	ErrInternal           = "internal"
+)
+
+// Envelope is a frame received from a client
+// ID is an optional client-chosen request ID echoed back in the matching ack or error frame
+// V is the protocol version of the frame and must match the one negotiated on connect when set
+type Envelope struct {
+	Type    string          `json:"type"`
+	ID      string          `json:"id,omitempty"`
+	V       int             `json:"v,omitempty"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+// JoinRequest asks to subscribe to or leave a single room
+type JoinRequest struct {
+	RoomID string `json:"roomId"`
+}
+
+// SubscribeRequest asks to subscribe to or leave several rooms at once
+type SubscribeRequest struct {
+	RoomIDs []string `json:"roomIds"`
+}
+
+// ResumeRequest subscribes to rooms after a reconnect and asks for the events missed since
+// Rooms maps each room ID to the last sequence the client saw in it
+type ResumeRequest struct {
+	Rooms map[string]int64 `json:"rooms"`
+}
+
+// MessageRequest is the payload of a "message" frame and mirrors MessageEvent
+type MessageRequest struct {
+	RoomID       string `json:"roomId"`
+	Content      string `json:"content"`
+	MediaURL     string `json:"mediaUrl,omitempty"`
+	ReplyTo      string `json:"replyTo,omitempty"`
+	ThreadID     string `json:"threadId,omitempty"`
+	ClientSideID string `json:"clientSideId,omitempty"`
+	// ScheduledID is set by the scheduler, never by clients
+	ScheduledID string `json:"-"`
+}
+
+// TypingRequest is the payload of "typing_start" and "typing_stop" frames and mirrors TypingEvent
+// The legacy "typing" frame is a typing_start
+type TypingRequest struct {
+	RoomID string `json:"roomId"`
+}
+
+// ReactionRequest is the payload of a "reaction" frame and mirrors ReactionEvent
+type ReactionRequest struct {
+	RoomID    string `json:"roomId"`
+	MessageID string `json:"messageId"`
+	Emoji     string `json:"emoji"`
+}
+
+// MessageActionRequest is the payload of "pin", "unpin", "star", "unstar" and "delete" frames
+// Scope only applies to delete: "everyone" (the default) or "me"
+type MessageActionRequest struct {
+	RoomID    string `json:"roomId,omitempty"`
+	MessageID string `json:"messageId"`
+	Scope     string `json:"scope,omitempty"`
+}
+
+// ForwardRequest is the payload of a "forward" frame and mirrors ForwardEvent
+type ForwardRequest struct {
+	MessageID string `json:"messageId"`
+	ToRoomID  string `json:"toRoomId"`
+}
+
+// EditRequest is the payload of an "edit" frame replacing the content of the sender's message
+type EditRequest struct {
+	RoomID    string `json:"roomId,omitempty"`
+	MessageID string `json:"messageId"`
+	Content   string `json:"content"`
+}
+
+// ReadRequest is the payload of a "read" frame marking a room's messages as read
+type ReadRequest struct {
+	RoomID string `json:"roomId"`
+}
+
+// HeartbeatRequest is the payload of a "heartbeat" frame sent periodically while the client is open
+// Status is "online" (the default) or "away" when the user is not looking at the app
+type HeartbeatRequest struct {
+	Status string `json:"status,omitempty"`
+}
+
+// DeliveredRequest is the payload of a "delivered" frame acknowledging received messages
+type DeliveredRequest struct {
+	RoomID     string   `json:"roomId,omitempty"`
+	MessageIDs []string `json:"messageIds"`
+}
+
+// HelloEvent is the first frame sent on a new connection and carries the negotiated protocol version
+type HelloEvent struct {
+	Type      string `json:"type"`
+	V         int    `json:"v"`
+	Versions  []int  `json:"versions"`
+	SessionID string `json:"sessionId"`
+	DeviceID  string `json:"deviceId"`
+}
+
+// AckEvent confirms a request; ID echoes the request ID of the frame being acknowledged
+// For sent messages MessageID is the server ID assigned to the message with the given ClientSideID
+// For subscriptions Seqs holds the current sequence of each room and Resync lists the rooms
+// whose missed events could not be replayed and must be refetched over REST
+type AckEvent struct {
+	Type         string           `json:"type"`
+	Action       string           `json:"action"`
+	ID           string           `json:"id,omitempty"`
+	RoomIDs      []string         `json:"roomIds,omitempty"`
+	Rejected     []string         `json:"rejected,omitempty"`
+	Resync       []string         `json:"resync,omitempty"`
+	Seqs         map[string]int64 `json:"seqs,omitempty"`
+	MessageID    string           `json:"messageId,omitempty"`
+	ClientSideID string           `json:"clientSideId,omitempty"`
+}
+
+// ErrorEvent reports a request the server refused to process
+type ErrorEvent struct {
+	Type    string `json:"type"`
+	Action  string `json:"action"`
+	ID      string `json:"id,omitempty"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	RoomID  string `json:"roomId,omitempty"`
+}
+
+// negotiateVersion picks the protocol version from the selected subprotocol or the "v" query parameter
+// Missing values fall back to the legacy protocol and versions newer than ours are capped at ProtocolLatest
+func negotiateVersion(subprotocol, requested string) (int, error) {
+	if subprotocol == Subprotocol {
+		return ProtocolV1, nil
+	}
+	if requested == "" {
+		return ProtocolLegacy, nil
+	}
+	v, err := strconv.Atoi(requested)
+	if err != nil || v < 0 {
+		return 0, errors.New("invalid protocol version")
+	}
+	if v > ProtocolLatest {
+		v = ProtocolLatest
+	}
+	return v, nil
+}
+
+// decodeEnvelope parses a raw frame for a connection speaking the given protocol version
+// Legacy frames carry their fields at the top level, so the whole frame doubles as the payload
+func decodeEnvelope(raw []byte, version int) (Envelope, *ErrorEvent) {
+	var env Envelope
+	if err := json.Unmarshal(raw, &env); err != nil {
+		return env, &ErrorEvent{Type: "error", Code: ErrBadFrame, Message: "Frame is not valid JSON"}
+	}
+	if env.Type == "" {
+		return env, &ErrorEvent{Type: "error", ID: env.ID, Code: ErrBadFrame, Message: "Frame has no type"}
+	}
+	if env.V != 0 && env.V != version {
+		return env, &ErrorEvent{Type: "error", Action: env.Type, ID: env.ID, Code: ErrUnsupportedVersion, Message: "Frame version does not match the negotiated version " + strconv.Itoa(version)}
+	}
+	if len(env.Payload) == 0 {
+		if version >= ProtocolV1 {
+			return env, &ErrorEvent{Type: "error", Action: env.Type, ID: env.ID, Code: ErrBadFrame, Message: "Frame has no payload"}
+		}
+		env.Payload = raw
+	}
+	return env, nil
+}
+
+// decodePayload unmarshals the payload of an envelope into the request struct for its type
+func decodePayload(env Envelope, req interface{}) *ErrorEvent {
+	if err := json.Unmarshal(env.Payload, req); err != nil {
+		return &ErrorEvent{Type: "error", Action: env.Type, ID: env.ID, Code: ErrBadRequest, Message: "Invalid payload for " + env.Type}
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+package sockets
+
+import "testing"
+
+func TestNegotiateVersion(t *testing.T) {
+	tests := []struct {
+		name        string
+		subprotocol string
+		requested   string
+		want        int
+		wantErr     bool
+	}{
+		{name: "subprotocol", subprotocol: Subprotocol, want: ProtocolV1},
+		{name: "subprotocol wins over query", subprotocol: Subprotocol, requested: "0", want: ProtocolV1},
+		{name: "nothing requested", want: ProtocolLegacy},
+		{name: "legacy", requested: "0", want: ProtocolLegacy},
+		{name: "v1", requested: "1", want: ProtocolV1},
+		{name: "newer than latest is capped", requested: "99", want: ProtocolLatest},
+		{name: "unknown subprotocol falls back to query", subprotocol: "line.v9", requested: "1", want: ProtocolV1},
+		{name: "negative", requested: "-1", wantErr: true},
+		{name: "not a number", requested: "v1", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := negotiateVersion(tt.subprotocol, tt.requested)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("negotiateVersion(%q, %q) error = %v, wantErr %v", tt.subprotocol, tt.requested, err, tt.wantErr)
+			}
+			if !tt.wantErr && got != tt.want {
+				t.Errorf("negotiateVersion(%q, %q) = %d, want %d", tt.subprotocol, tt.requested, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDecodeEnvelope(t *testing.T) {
+	tests := []struct {
+		name        string
+		raw         string
+		version     int
+		wantType    string
+		wantPayload string
+		wantCode    string
+	}{
+		{name: "v1 frame", raw: `{"type":"message","id":"1","payload":{"roomId":"r"}}`, version: ProtocolV1, wantType: "message", wantPayload: `{"roomId":"r"}`},
+		{name: "v1 frame with matching v", raw: `{"type":"join","v":1,"payload":{}}`, version: ProtocolV1, wantType: "join", wantPayload: `{}`},
+		{name: "legacy frame uses the whole frame as payload", raw: `{"type":"join","roomId":"r"}`, version: ProtocolLegacy, wantType: "join", wantPayload: `{"type":"join","roomId":"r"}`},
+		{name: "legacy frame with payload", raw: `{"type":"join","payload":{"roomId":"r"}}`, version: ProtocolLegacy, wantType: "join", wantPayload: `{"roomId":"r"}`},
+		{name: "invalid JSON", raw: `{"type":`, version: ProtocolV1, wantCode: ErrBadFrame},
+		{name: "not an object", raw: `[1,2]`, version: ProtocolV1, wantCode: ErrBadFrame},
+		{name: "missing type", raw: `{"payload":{}}`, version: ProtocolV1, wantCode: ErrBadFrame},
+		{name: "version mismatch", raw: `{"type":"join","v":1,"payload":{}}`, version: ProtocolLegacy, wantCode: ErrUnsupportedVersion},
+		{name: "v1 frame without payload", raw: `{"type":"heartbeat"}`, version: ProtocolV1, wantCode: ErrBadFrame},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env, errEvent := decodeEnvelope([]byte(tt.raw), tt.version)
+			if tt.wantCode != "" {
+				if errEvent == nil {
+					t.Fatalf("decodeEnvelope(%s) succeeded, want %s", tt.raw, tt.wantCode)
+				}
+				if errEvent.Code != tt.wantCode {
+					t.Errorf("decodeEnvelope(%s) code = %s, want %s", tt.raw, errEvent.Code, tt.wantCode)
+				}
+				return
+			}
+			if errEvent != nil {
+				t.Fatalf("decodeEnvelope(%s) failed: %s", tt.raw, errEvent.Message)
+			}
+			if env.Type != tt.wantType {
+				t.Errorf("type = %q, want %q", env.Type, tt.wantType)
+			}
+			if string(env.Payload) != tt.wantPayload {
+				t.Errorf("payload = %s, want %s", env.Payload, tt.wantPayload)
+			}
+		})
+	}
+}
+
+func TestDecodeEnvelopeKeepsFrameID(t *testing.T) {
+	_, errEvent := decodeEnvelope([]byte(`{"type":"join","id":"abc","v":2,"payload":{}}`), ProtocolV1)
+	if errEvent == nil {
+		t.Fatal("decodeEnvelope accepted a frame for another version")
+	}
+	if errEvent.ID != "abc" || errEvent.Action != "join" {
+		t.Errorf("error frame id = %q, action = %q, want abc and join", errEvent.ID, errEvent.Action)
+	}
+}
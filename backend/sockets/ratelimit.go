@@ -0,0 +1,204 @@
+package sockets
+
+import (
+	"fmt"
+	"line/config"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// RateLimit is a token bucket refilled at PerSecond tokens per second holding at most Burst tokens
+// A zero PerSecond means the event type is not limited
+type RateLimit struct {
+	PerSecond float64
+	Burst     float64
+}
+
+// defaultLimitKey holds the limit applied to event types without their own entry
+const defaultLimitKey = "default"
+
+// UserRateLimits are the per-user limits by event type, shared by all of a user's connections
+// Clients ack every message they receive, so delivered and read allow twice a room's message rate
+var UserRateLimits = map[string]RateLimit{
+	"message":       {PerSecond: 5, Burst: 10},
+	"typing":        {PerSecond: 2, Burst: 5},
+	"reaction":      {PerSecond: 5, Burst: 10},
+	"delivered":     {PerSecond: 40, Burst: 80},
+	"read":          {PerSecond: 40, Burst: 80},
+	defaultLimitKey: {PerSecond: 10, Burst: 20},
+}
+
+// RoomRateLimits are the per-room limits by event type, shared by all members of a room
+var RoomRateLimits = map[string]RateLimit{
+	"message":  {PerSecond: 20, Burst: 40},
+	"typing":   {PerSecond: 10, Burst: 20},
+	"reaction": {PerSecond: 20, Burst: 40},
+}
+
+// LoadRateLimits overrides the limits from WS_RATE_<TYPE> and WS_ROOM_RATE_<TYPE>, written as "rate/burst" (e.g. "5/10")
+func LoadRateLimits() {
+	for _, eventType := range []string{"message", "typing", "reaction", "delivered", "read", defaultLimitKey} {
+		key := strings.ToUpper(eventType)
+		if limit, ok := parseRateLimit("WS_RATE_" + key); ok {
+			UserRateLimits[eventType] = limit
+		}
+		if limit, ok := parseRateLimit("WS_ROOM_RATE_" + key); ok {
+			RoomRateLimits[eventType] = limit
+		}
+	}
+}
+
+func parseRateLimit(key string) (RateLimit, bool) {
+	value := config.GetEnv(key, "")
+	if value == "" {
+		return RateLimit{}, false
+	}
+	rate, burst, found := strings.Cut(value, "/")
+	perSecond, err1 := strconv.ParseFloat(rate, 64)
+	size, err2 := strconv.ParseFloat(burst, 64)
+	if !found || err1 != nil || err2 != nil || perSecond < 0 || size < 1 {
+		log.Printf("Invalid value for %s, expected rate/burst", key)
+		return RateLimit{}, false
+	}
+	return RateLimit{PerSecond: perSecond, Burst: size}, true
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// limiter holds the token buckets of this instance keyed by scope, ID and event type
+type limiter struct {
+	mu      sync.Mutex
+	buckets map[string]*bucket
+	sweep   sync.Once
+}
+
+var limits = &limiter{buckets: make(map[string]*bucket)}
+
+// take removes a token from the bucket, returning how long to wait for one if it is empty
+func (l *limiter) take(key string, limit RateLimit) (bool, time.Duration) {
+	if limit.PerSecond <= 0 {
+		return true, 0
+	}
+	l.sweep.Do(func() { go l.sweepIdle() })
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: limit.Burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens += now.Sub(b.last).Seconds() * limit.PerSecond
+	if b.tokens > limit.Burst {
+		b.tokens = limit.Burst
+	}
+	b.last = now
+	if b.tokens < 1 {
+		wait := time.Duration((1 - b.tokens) / limit.PerSecond * float64(time.Second))
+		return false, wait
+	}
+	b.tokens--
+	return true, 0
+}
+
+// sweepIdle drops buckets that have been idle long enough to be full again
+func (l *limiter) sweepIdle() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for range ticker.C {
+		l.mu.Lock()
+		for key, b := range l.buckets {
+			if time.Since(b.last) > time.Minute {
+				delete(l.buckets, key)
+			}
+		}
+		l.mu.Unlock()
+	}
+}
+
+// limitAliases maps frame types onto the event type whose limits they share
+var limitAliases = map[string]string{
+	"typing_start": "typing",
+	"typing_stop":  "typing",
+}
+
+// limitClass returns the event type a frame is limited and bucketed as
+// Types the dispatcher does not handle all share the default class, so made-up types cannot grow the bucket map
+func limitClass(frameType string) string {
+	if alias, ok := limitAliases[frameType]; ok {
+		return alias
+	}
+	if frameTypes[frameType] {
+		return frameType
+	}
+	return defaultLimitKey
+}
+
+// limitFor returns the limit of an event class, falling back to the default entry
+func limitFor(limits map[string]RateLimit, class string) RateLimit {
+	if limit, ok := limits[class]; ok {
+		return limit
+	}
+	return limits[defaultLimitKey]
+}
+
+// RateLimitedEvent tells a client its frame was dropped and when it may try again
+type RateLimitedEvent struct {
+	Type         string `json:"type"`
+	Action       string `json:"action"`
+	ID           string `json:"id,omitempty"`
+	RoomID       string `json:"roomId,omitempty"`
+	RetryAfterMs int64  `json:"retryAfterMs"`
+}
+
+// allowUser applies the user's limit to a frame
+// Throttled frames are answered with a rate_limited frame; a client throttled more than
+// Opts.RateLimitStrikes times within Opts.RateLimitWindow is disconnected
+func (c *Client) allowUser(env Envelope) bool {
+	class := limitClass(env.Type)
+	ok, wait := limits.take(fmt.Sprintf("user:%s:%s", c.UserID, class), limitFor(UserRateLimits, class))
+	if !ok {
+		c.throttled(env, "", wait)
+	}
+	return ok
+}
+
+// allowRoom applies the room's limit to a frame naming a room the user is a member of
+func (c *Client) allowRoom(env Envelope, roomID string) bool {
+	if roomID == "" {
+		return true
+	}
+	class := limitClass(env.Type)
+	ok, wait := limits.take(fmt.Sprintf("room:%s:%s", roomID, class), limitFor(RoomRateLimits, class))
+	if !ok {
+		c.throttled(env, roomID, wait)
+	}
+	return ok
+}
+
+// throttled answers a dropped frame and disconnects the client once it has too many strikes
+func (c *Client) throttled(env Envelope, roomID string, wait time.Duration) {
+	c.enqueue(RateLimitedEvent{Type: "rate_limited", Action: env.Type, ID: env.ID, RoomID: roomID, RetryAfterMs: wait.Milliseconds()})
+
+	now := time.Now()
+	c.strikeMu.Lock()
+	if now.Sub(c.strikesSince) > Opts.RateLimitWindow {
+		c.strikesSince = now
+		c.strikes = 0
+	}
+	c.strikes++
+	flooding := c.strikes > Opts.RateLimitStrikes
+	c.strikeMu.Unlock()
+	if flooding {
+		log.Printf("Disconnecting flooding client user=%s session=%s transport=%s type=%s", c.UserID, c.SessionID, c.Transport, env.Type)
+		c.closeWith(websocket.ClosePolicyViolation, "rate limit exceeded")
+	}
+}
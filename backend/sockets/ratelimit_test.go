@@ -0,0 +1,191 @@
+package sockets
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLimiterTake(t *testing.T) {
+	l := &limiter{buckets: make(map[string]*bucket)}
+	limit := RateLimit{PerSecond: 1, Burst: 2}
+
+	for i := 0; i < 2; i++ {
+		if ok, _ := l.take("k", limit); !ok {
+			t.Fatalf("take %d within the burst was refused", i+1)
+		}
+	}
+	ok, wait := l.take("k", limit)
+	if ok {
+		t.Fatal("take past the burst was allowed")
+	}
+	if wait <= 0 || wait > time.Second {
+		t.Errorf("wait = %s, want within (0, 1s]", wait)
+	}
+	if ok, _ := l.take("other", limit); !ok {
+		t.Error("an empty bucket throttled another key")
+	}
+
+	// A second later one token is back, but no more than that
+	l.buckets["k"].last = l.buckets["k"].last.Add(-time.Second)
+	if ok, _ := l.take("k", limit); !ok {
+		t.Error("take after refilling was refused")
+	}
+	if ok, _ := l.take("k", limit); ok {
+		t.Error("refill added more than one token")
+	}
+
+	// A long idle period refills only up to the burst
+	l.buckets["k"].last = l.buckets["k"].last.Add(-time.Hour)
+	for i := 0; i < 2; i++ {
+		if ok, _ := l.take("k", limit); !ok {
+			t.Fatalf("take %d after idling was refused", i+1)
+		}
+	}
+	if ok, _ := l.take("k", limit); ok {
+		t.Error("idle bucket held more than the burst")
+	}
+}
+
+func TestLimiterTakeUnlimited(t *testing.T) {
+	l := &limiter{buckets: make(map[string]*bucket)}
+	for i := 0; i < 100; i++ {
+		if ok, _ := l.take("k", RateLimit{}); !ok {
+			t.Fatal("a zero limit throttled")
+		}
+	}
+	if len(l.buckets) != 0 {
+		t.Errorf("a zero limit created %d buckets", len(l.buckets))
+	}
+}
+
+func TestLimitClass(t *testing.T) {
+	tests := []struct {
+		frameType string
+		want      string
+	}{
+		{"message", "message"},
+		{"typing", "typing"},
+		{"typing_start", "typing"},
+		{"typing_stop", "typing"},
+		{"pin", "pin"},
+		{"heartbeat", "heartbeat"},
+		{"made_up", defaultLimitKey},
+		{"", defaultLimitKey},
+	}
+	for _, tt := range tests {
+		if got := limitClass(tt.frameType); got != tt.want {
+			t.Errorf("limitClass(%q) = %q, want %q", tt.frameType, got, tt.want)
+		}
+	}
+}
+
+func TestLimitFor(t *testing.T) {
+	limits := map[string]RateLimit{
+		"message":       {PerSecond: 5, Burst: 10},
+		defaultLimitKey: {PerSecond: 1, Burst: 1},
+	}
+	if got := limitFor(limits, "message"); got != limits["message"] {
+		t.Errorf("limitFor(message) = %+v, want its own entry", got)
+	}
+	if got := limitFor(limits, "pin"); got != limits[defaultLimitKey] {
+		t.Errorf("limitFor(pin) = %+v, want the default entry", got)
+	}
+	if got := limitFor(map[string]RateLimit{}, "pin"); got != (RateLimit{}) {
+		t.Errorf("limitFor without a default = %+v, want no limit", got)
+	}
+}
+
+func TestAcksKeepUpWithRoomMessages(t *testing.T) {
+	room := RoomRateLimits["message"]
+	for _, frameType := range []string{"delivered", "read"} {
+		t.Run(frameType, func(t *testing.T) {
+			limit := limitFor(UserRateLimits, limitClass(frameType))
+			if limit.PerSecond < room.PerSecond || limit.Burst < room.Burst {
+				t.Fatalf("user limit %+v is below the room message limit %+v", limit, room)
+			}
+
+			// Ack a room sending at its full rate for ten seconds, burst first
+			l := &limiter{buckets: make(map[string]*bucket)}
+			for i := 0; i < int(room.Burst); i++ {
+				if ok, _ := l.take("k", limit); !ok {
+					t.Fatalf("ack %d of the burst was throttled", i+1)
+				}
+			}
+			for second := 1; second <= 10; second++ {
+				l.buckets["k"].last = l.buckets["k"].last.Add(-time.Second)
+				for i := 0; i < int(room.PerSecond); i++ {
+					if ok, _ := l.take("k", limit); !ok {
+						t.Fatalf("ack %d in second %d was throttled", i+1, second)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestParseRateLimit(t *testing.T) {
+	tests := []struct {
+		value  string
+		want   RateLimit
+		wantOK bool
+	}{
+		{value: "5/10", want: RateLimit{PerSecond: 5, Burst: 10}, wantOK: true},
+		{value: "0.5/1", want: RateLimit{PerSecond: 0.5, Burst: 1}, wantOK: true},
+		{value: "0/1", want: RateLimit{PerSecond: 0, Burst: 1}, wantOK: true},
+		{value: ""},
+		{value: "5"},
+		{value: "5/"},
+		{value: "x/10"},
+		{value: "-1/10"},
+		{value: "5/0"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			t.Setenv("WS_RATE_TEST", tt.value)
+			got, ok := parseRateLimit("WS_RATE_TEST")
+			if ok != tt.wantOK || got != tt.want {
+				t.Errorf("parseRateLimit(%q) = %+v, %v, want %+v, %v", tt.value, got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestStrikeEscalation(t *testing.T) {
+	saved, savedLimit := Opts, UserRateLimits["message"]
+	defer func() {
+		Opts = saved
+		UserRateLimits["message"] = savedLimit
+	}()
+	Opts.RateLimitStrikes = 2
+	Opts.RateLimitWindow = time.Minute
+	UserRateLimits["message"] = RateLimit{PerSecond: 0.001, Burst: 1}
+
+	c := &Client{UserID: "strike-test", Send: make(chan interface{}, 10), done: make(chan struct{})}
+	env := Envelope{Type: "message", ID: "1"}
+	if !c.allowUser(env) {
+		t.Fatal("first frame was throttled")
+	}
+	for strike := 1; strike <= Opts.RateLimitStrikes; strike++ {
+		if c.allowUser(env) {
+			t.Fatal("frame after the burst was allowed")
+		}
+		if c.closed() {
+			t.Fatalf("client was closed after %d strikes", strike)
+		}
+	}
+	if ev, ok := (<-c.Send).(RateLimitedEvent); !ok || ev.Action != "message" || ev.RetryAfterMs <= 0 {
+		t.Errorf("throttled frame answered with %+v, want a rate_limited frame", ev)
+	}
+
+	// Strikes outside the window start over
+	c.strikesSince = time.Now().Add(-2 * Opts.RateLimitWindow)
+	c.allowUser(env)
+	if c.closed() || c.strikes != 1 {
+		t.Fatalf("strikes = %d after the window, want 1 and the client open", c.strikes)
+	}
+	c.allowUser(env)
+	c.allowUser(env)
+	if !c.closed() {
+		t.Error("client past the strike limit was not closed")
+	}
+}
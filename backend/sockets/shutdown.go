@@ -0,0 +1,149 @@
+package sockets
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Shutdown state shared by the hub, the socket handlers and the frame dispatcher
+// Once closing is set no connection is accepted and no inbound frame is handled
+// work counts frames whose handler may still be writing to MongoDB or feeding the hub
+var lifecycle struct {
+	mu        sync.Mutex
+	closing   bool
+	goingAway chan struct{}
+	work      sync.WaitGroup
+}
+
+func init() {
+	lifecycle.goingAway = make(chan struct{})
+}
+
+// Closing reports whether the server has started shutting down
+func Closing() bool {
+	lifecycle.mu.Lock()
+	defer lifecycle.mu.Unlock()
+	return lifecycle.closing
+}
+
+// beginWork registers an inbound frame with the shutdown tracker
+// It returns false once the server is shutting down, in which case the frame is ignored
+func beginWork() bool {
+	lifecycle.mu.Lock()
+	defer lifecycle.mu.Unlock()
+	if lifecycle.closing {
+		return false
+	}
+	lifecycle.work.Add(1)
+	return true
+}
+
+// endWork marks a frame registered with beginWork as handled
+func endWork() {
+	lifecycle.work.Done()
+}
+
+// GoAway stops accepting connections and frames and tells every client the server is going away
+// WebSocket clients are sent their queued frames followed by a 1001 close frame; SSE and
+// long-poll sessions end their current response. It is safe to call more than once
+func (h *Hub) GoAway() {
+	lifecycle.mu.Lock()
+	if lifecycle.closing {
+		lifecycle.mu.Unlock()
+		return
+	}
+	lifecycle.closing = true
+	close(lifecycle.goingAway)
+	lifecycle.mu.Unlock()
+
+	// WritePump closes sockets itself so the queue is flushed before the close frame
+	for _, c := range h.connections() {
+		if c.Conn != nil {
+			continue
+		}
+		c.closeWith(websocket.CloseGoingAway, "server shutting down")
+		if c.Transport == TransportPoll {
+			// An idle long-poll session has no request that would notice and release it
+			closeFallback(c)
+		}
+	}
+}
+
+// Shutdown takes the hub down after GoAway
+// It waits for in-flight frames to finish, for every connection to be released and for the
+// hub's lanes to publish what is still queued, then closes the broker. ctx bounds the whole wait
+func (h *Hub) Shutdown(ctx context.Context) error {
+	h.GoAway()
+
+	handled := make(chan struct{})
+	go func() {
+		lifecycle.work.Wait()
+		close(handled)
+	}()
+	select {
+	case <-handled:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+	for len(h.connections()) > 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+
+	// The hub channels are unbuffered, so every event sent by a released connection or a finished
+	// frame has already been taken by Run and queued on a lane; the lanes are drained below
+	select {
+	case h.stop <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	published := make(chan struct{})
+	go func() {
+		h.laneWork.Wait()
+		close(published)
+	}()
+	select {
+	case <-published:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return h.broker.Close()
+}
+
+// connections returns every client registered on this instance
+func (h *Hub) connections() []*Client {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var clients []*Client
+	for _, conns := range h.Clients {
+		for c := range conns {
+			clients = append(clients, c)
+		}
+	}
+	return clients
+}
+
+// flush writes whatever is still queued for the client, stopping at the first write error
+func (c *Client) flush() {
+	for {
+		select {
+		case msg := <-c.Send:
+			c.Conn.SetWriteDeadline(time.Now().Add(Opts.WriteWait))
+			if err := c.Conn.WriteJSON(msg); err != nil {
+				return
+			}
+		default:
+			return
+		}
+	}
+}
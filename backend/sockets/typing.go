@@ -0,0 +1,127 @@
+package sockets
+
+import (
+	"encoding/json"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// typingTopic is the broker message type carrying typing_start and typing_stop between instances
+// Every instance applies them to its own typingTracker and pushes snapshots to its local subscribers
+const typingTopic = "_typing"
+
+// TypingStateEvent is the aggregated list of users currently typing in a room
+// It is pushed to the room whenever someone starts, stops or times out
+type TypingStateEvent struct {
+	Type    string   `json:"type"`
+	RoomID  string   `json:"roomId"`
+	UserIDs []string `json:"userIds"`
+}
+
+// typingTracker holds, per room, when each typist's typing state expires
+type typingTracker struct {
+	mu    sync.Mutex
+	rooms map[string]map[string]time.Time
+}
+
+func newTypingTracker() *typingTracker {
+	return &typingTracker{rooms: make(map[string]map[string]time.Time)}
+}
+
+// start marks the user as typing until the TTL runs out and reports whether they were not typing before
+func (t *typingTracker) start(roomID, userID string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.rooms[roomID] == nil {
+		t.rooms[roomID] = make(map[string]time.Time)
+	}
+	_, already := t.rooms[roomID][userID]
+	t.rooms[roomID][userID] = time.Now().Add(Opts.TypingTTL)
+	return !already
+}
+
+// stop clears the user's typing state and reports whether they were typing
+func (t *typingTracker) stop(roomID, userID string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, ok := t.rooms[roomID][userID]; !ok {
+		return false
+	}
+	delete(t.rooms[roomID], userID)
+	if len(t.rooms[roomID]) == 0 {
+		delete(t.rooms, roomID)
+	}
+	return true
+}
+
+// expire clears every typing state past its TTL and returns the rooms that changed
+func (t *typingTracker) expire(now time.Time) []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var changed []string
+	for roomID, typists := range t.rooms {
+		before := len(typists)
+		for userID, until := range typists {
+			if now.After(until) {
+				delete(typists, userID)
+			}
+		}
+		if len(typists) != before {
+			changed = append(changed, roomID)
+		}
+		if len(typists) == 0 {
+			delete(t.rooms, roomID)
+		}
+	}
+	return changed
+}
+
+// snapshot returns the sorted IDs of the users typing in a room
+func (t *typingTracker) snapshot(roomID string) []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	userIDs := make([]string, 0, len(t.rooms[roomID]))
+	for userID := range t.rooms[roomID] {
+		userIDs = append(userIDs, userID)
+	}
+	sort.Strings(userIDs)
+	return userIDs
+}
+
+// applyTyping updates the typing state from a typing_start or typing_stop event
+// A start is also relayed to the other members as the legacy "typing" event older clients listen for
+func (h *Hub) applyTyping(msg BrokerMessage) {
+	var ev TypingEvent
+	if err := json.Unmarshal(msg.Data, &ev); err != nil {
+		log.Println("Typing decode error:", err)
+		return
+	}
+	var changed bool
+	if ev.Type == "typing_stop" {
+		changed = h.typists.stop(ev.RoomID, ev.UserID)
+	} else {
+		changed = h.typists.start(ev.RoomID, ev.UserID)
+		h.deliverLocal("typing", ev.RoomID, ev.UserID, TypingEvent{Type: "typing", RoomID: ev.RoomID, UserID: ev.UserID})
+	}
+	if changed {
+		h.pushTypingState(ev.RoomID)
+	}
+}
+
+// pushTypingState sends the current typing snapshot of a room to its local subscribers
+func (h *Hub) pushTypingState(roomID string) {
+	h.deliverLocal("typing_state", roomID, "", TypingStateEvent{Type: "typing_state", RoomID: roomID, UserIDs: h.typists.snapshot(roomID)})
+}
+
+// expireTypists clears timed out typing states and pushes the new snapshots
+func (h *Hub) expireTypists() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		for _, roomID := range h.typists.expire(now) {
+			h.pushTypingState(roomID)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package sockets
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestTypingTracker(t *testing.T) {
+	saved := Opts.TypingTTL
+	defer func() { Opts.TypingTTL = saved }()
+	Opts.TypingTTL = time.Minute
+
+	tr := newTypingTracker()
+	if !tr.start("r1", "bob") {
+		t.Error("first start did not report a change")
+	}
+	if tr.start("r1", "bob") {
+		t.Error("refreshing a start reported a change")
+	}
+	tr.start("r1", "alice")
+	tr.start("r2", "carol")
+	if got := tr.snapshot("r1"); !reflect.DeepEqual(got, []string{"alice", "bob"}) {
+		t.Errorf("snapshot(r1) = %v, want [alice bob]", got)
+	}
+	if !tr.stop("r1", "bob") {
+		t.Error("stop of a typist did not report a change")
+	}
+	if tr.stop("r1", "bob") {
+		t.Error("stop of a user who is not typing reported a change")
+	}
+	if got := tr.snapshot("nowhere"); len(got) != 0 {
+		t.Errorf("snapshot of an unknown room = %v, want empty", got)
+	}
+}
+
+func TestTypingTrackerExpire(t *testing.T) {
+	saved := Opts.TypingTTL
+	defer func() { Opts.TypingTTL = saved }()
+	Opts.TypingTTL = 5 * time.Second
+
+	now := time.Now()
+	tests := []struct {
+		name        string
+		at          time.Time
+		wantChanged []string
+		wantR1      []string
+		wantR2      []string
+	}{
+		{name: "before the TTL", at: now, wantChanged: nil, wantR1: []string{"alice", "bob"}, wantR2: []string{"carol"}},
+		{name: "after the TTL", at: now.Add(10 * time.Second), wantChanged: []string{"r1", "r2"}, wantR1: []string{}, wantR2: []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tr := newTypingTracker()
+			tr.start("r1", "alice")
+			tr.start("r1", "bob")
+			tr.start("r2", "carol")
+			changed := tr.expire(tt.at)
+			sort.Strings(changed)
+			if !reflect.DeepEqual(changed, tt.wantChanged) {
+				t.Errorf("expire changed %v, want %v", changed, tt.wantChanged)
+			}
+			if got := tr.snapshot("r1"); !reflect.DeepEqual(got, tt.wantR1) {
+				t.Errorf("snapshot(r1) = %v, want %v", got, tt.wantR1)
+			}
+			if got := tr.snapshot("r2"); !reflect.DeepEqual(got, tt.wantR2) {
+				t.Errorf("snapshot(r2) = %v, want %v", got, tt.wantR2)
+			}
+		})
+	}
+}
+
+func TestTypingTrackerExpireKeepsRefreshed(t *testing.T) {
+	saved := Opts.TypingTTL
+	defer func() { Opts.TypingTTL = saved }()
+	Opts.TypingTTL = time.Second
+
+	tr := newTypingTracker()
+	tr.start("r1", "alice")
+	tr.rooms["r1"]["alice"] = time.Now().Add(-time.Millisecond)
+	tr.start("r1", "bob")
+	if changed := tr.expire(time.Now()); !reflect.DeepEqual(changed, []string{"r1"}) {
+		t.Errorf("expire changed %v, want [r1]", changed)
+	}
+	if got := tr.snapshot("r1"); !reflect.DeepEqual(got, []string{"bob"}) {
+		t.Errorf("snapshot(r1) = %v, want [bob]", got)
+	}
+}
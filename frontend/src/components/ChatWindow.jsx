@@ -365,7 +365,7 @@ export default function ChatWindow() {
       headers: { Authorization: "Bearer " + token },
     });
     const data = await res.json();
-    setMessages(Array.isArray(data) ? data : []);
+    setMessages(Array.isArray(data?.messages) ? data.messages : []);
   };
 
   // Helper to get participant IDs (excluding self)
@@ -71,7 +71,7 @@ export function ChatProvider({ children }) {
         headers: { Authorization: "Bearer " + token },
       })
         .then((res) => res.json())
-        .then((data) => setMessages(Array.isArray(data) ? data.sort((a, b) => new Date(a.timestamp) - new Date(b.timestamp)) : []));
+        .then((data) => setMessages(Array.isArray(data?.messages) ? data.messages : []));
       // Mark all as read
       fetch(`http://localhost:8080/rooms/${currentRoom.id}/messages/mark-read`, {
         method: "POST",